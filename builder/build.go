@@ -17,10 +17,12 @@
 package builder
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -74,13 +76,14 @@ func (p *Package) CreateDirs(o *Overlay) error {
 }
 
 // FetchSources will attempt to fetch the sources from the network
-// if necessary
-func (p *Package) FetchSources(o *Overlay) error {
+// if necessary, writing any progress to out.
+func (p *Package) FetchSources(o *Overlay, out io.Writer) error {
 	for _, source := range p.Sources {
 		// Already fetched, skip it
 		if source.IsFetched() {
 			continue
 		}
+		source.SetOutput(out)
 		if err := source.Fetch(); err != nil {
 			log.WithFields(log.Fields{
 				"error":  err,
@@ -145,9 +148,6 @@ func (p *Package) BindSources(o *Overlay) error {
 			}).Error("Failed to bind mount source")
 			return err
 		}
-
-		// Account for these to help cleanups
-		o.ExtraMounts = append(o.ExtraMounts, bindConfig.BindTarget)
 	}
 	return nil
 }
@@ -176,7 +176,6 @@ func (p *Package) BindCcache(o *Overlay) error {
 		}).Error("Failed to bind mount ccache")
 		return err
 	}
-	o.ExtraMounts = append(o.ExtraMounts, ccacheDir)
 	return nil
 }
 
@@ -345,7 +344,7 @@ func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager
 		}
 
 		// Ensure the overlay can network on localhost only
-		if err := overlay.ConfigureNetworking(); err != nil {
+		if err := overlay.ConfigureNetworking(notif); err != nil {
 			return err
 		}
 	} else {
@@ -450,15 +449,65 @@ func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overl
 	return nil
 }
 
+// PrepareOutputDir will ensure the output directory for build artifacts exists,
+// returning its absolute path. An empty dir is the users current directory.
+// Any directories created are owned by the user, as with the artifacts.
+func PrepareOutputDir(dir string, usr *UserInfo) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Find which directories we'll need to create
+	var created []string
+	for p := dir; !PathExists(p); p = filepath.Dir(p) {
+		created = append(created, p)
+	}
+	if len(created) == 0 {
+		return dir, nil
+	}
+
+	log.WithFields(log.Fields{
+		"dir": dir,
+	}).Debug("Creating output directory")
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		log.WithFields(log.Fields{
+			"dir":   dir,
+			"error": err,
+		}).Error("Failed to create output directory")
+		return "", err
+	}
+	for _, p := range created {
+		if err := os.Chown(p, usr.UID, usr.GID); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"dir":   p,
+			}).Error("Error in restoring directory ownership")
+		}
+	}
+	return dir, nil
+}
+
 // CollectAssets will search for the build files and copy them back to the
-// users current directory. If solbuild was invoked via sudo, solbuild will
-// then attempt to set the owner as the original user.
-func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget string) error {
+// output directory, or the users current directory if empty. If solbuild was
+// invoked via sudo, solbuild will then attempt to set the owner as the
+// original user.
+func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget, outputDir string) error {
+	_, err := p.collectAssets(overlay, usr, manifestTarget, outputDir)
+	return err
+}
+
+// collectAssets does the real work of CollectAssets, returning the paths of
+// the collected files.
+func (p *Package) collectAssets(overlay *Overlay, usr *UserInfo, manifestTarget, outputDir string) ([]string, error) {
 	collectionDir := p.GetWorkDir(overlay)
 	collections, _ := filepath.Glob(filepath.Join(collectionDir, "*.eopkg"))
 	if len(collections) < 1 {
 		log.Error("Mysterious lack of eopkg files is mysterious")
-		return errors.New("Internal error: .eopkg files are missing")
+		return nil, errors.New("Internal error: .eopkg files are missing")
 	}
 
 	// Prior to blitting the files out, let's grab the manifest if requested
@@ -470,7 +519,7 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 					"path":  p,
 					"error": err,
 				}).Error("Failed to collect eopkg asset for transit manifest")
-				return err
+				return nil, err
 			}
 		}
 
@@ -481,7 +530,7 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 
 		// Try to write manifest
 		if err := tram.Write(tramPath); err != nil {
-			return err
+			return nil, err
 		}
 
 		// Worked, great. Now ensure our next cycle collects, chowns, etc.
@@ -497,14 +546,14 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 		"numFiles": len(collections),
 	}).Debug("Collecting files")
 
+	outputDir, err := PrepareOutputDir(outputDir, usr)
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []string
 	for _, p := range collections {
-		tgt, err := filepath.Abs(filepath.Join(".", filepath.Base(p)))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("Unable to find working directory!")
-			return err
-		}
+		tgt := filepath.Join(outputDir, filepath.Base(p))
 
 		log.WithFields(log.Fields{
 			"file": filepath.Base(p),
@@ -514,8 +563,9 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 			log.WithFields(log.Fields{
 				"error": err,
 			}).Error("Unable to collect build file")
-			return err
+			return collected, err
 		}
+		collected = append(collected, tgt)
 
 		log.WithFields(log.Fields{
 			"uid":  usr.UID,
@@ -530,11 +580,11 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 			}).Error("Error in restoring file ownership")
 		}
 	}
-	return nil
+	return collected, nil
 }
 
 // Build will attempt to build the package in the overlayfs system
-func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay, manifestTarget string) error {
+func (p *Package) Build(ctx context.Context, notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay, manifestTarget, outputDir string) error {
 	log.WithFields(log.Fields{
 		"profile": overlay.Back.Name,
 		"version": p.Version,
@@ -554,17 +604,23 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	ChrootEnvironment = env
 
 	// Set up environment
-	if err := overlay.CleanExisting(); err != nil {
+	if err := p.runPhase(notif, PhaseClean, func(*Event) error {
+		return overlay.CleanExisting()
+	}); err != nil {
 		return err
 	}
 
 	// Bring up the root
-	if err := p.ActivateRoot(overlay); err != nil {
+	if err := p.runPhase(notif, PhaseActivateRoot, func(*Event) error {
+		return p.ActivateRoot(overlay)
+	}); err != nil {
 		return err
 	}
 
 	// Ensure source assets are in place
-	if err := p.CopyAssets(history, overlay); err != nil {
+	if err := p.runPhase(notif, PhaseCopyAssets, func(*Event) error {
+		return p.CopyAssets(history, overlay)
+	}); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to copy required source assets")
@@ -572,18 +628,34 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	}
 
 	log.Debug("Validating sources")
-	if err := p.FetchSources(overlay); err != nil {
+	if err := p.runPhase(notif, PhaseFetchSources, func(e *Event) error {
+		data := &SourcesData{}
+		for _, source := range p.Sources {
+			if source.IsFetched() {
+				data.Cached = append(data.Cached, source.GetIdentifier())
+			} else {
+				data.Fetched = append(data.Fetched, source.GetIdentifier())
+			}
+		}
+		e.Data = data
+		stdout, _ := outputFor(notif)
+		return p.FetchSources(overlay, stdout)
+	}); err != nil {
 		return err
 	}
 
 	// Set up package manager
-	if err := pman.Init(); err != nil {
+	if err := p.runPhase(notif, PhaseInitPackageManager, func(*Event) error {
+		return pman.Init()
+	}); err != nil {
 		return err
 	}
 
 	// Bring up dbus to do Things
 	log.Debug("Starting D-BUS")
-	if err := pman.StartDBUS(); err != nil {
+	if err := p.runPhase(notif, PhaseStartDBUS, func(*Event) error {
+		return pman.StartDBUS()
+	}); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to start d-bus")
@@ -591,7 +663,11 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	}
 
 	// Get the repos in place before asserting anything
-	if err := p.ConfigureRepos(notif, overlay, pman, profile); err != nil {
+	if err := p.runPhase(notif, PhaseConfigureRepos, func(e *Event) error {
+		data, err := p.configureRepos(ctx, notif, overlay, pman, profile)
+		e.Data = data
+		return err
+	}); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Configuring repositories failed")
@@ -599,7 +675,9 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	}
 
 	log.Debug("Upgrading system base")
-	if err := pman.Upgrade(); err != nil {
+	if err := p.runPhase(notif, PhaseUpgrade, func(*Event) error {
+		return pman.Upgrade()
+	}); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to upgrade rootfs")
@@ -607,7 +685,10 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	}
 
 	log.Debug("Asserting system.devel component installation")
-	if err := pman.InstallComponent("system.devel"); err != nil {
+	if err := p.runPhase(notif, PhaseInstallComponent, func(e *Event) error {
+		e.Data = &ComponentData{Component: "system.devel"}
+		return pman.InstallComponent("system.devel")
+	}); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to assert system.devel")
@@ -615,20 +696,25 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	}
 
 	// Ensure all directories are in place
-	if err := p.CreateDirs(overlay); err != nil {
+	if err := p.runPhase(notif, PhaseCreateDirs, func(*Event) error {
+		return p.CreateDirs(overlay)
+	}); err != nil {
 		return err
 	}
 
 	// Call the relevant build function
-	if p.Type == PackageTypeYpkg {
-		if err := p.BuildYpkg(notif, usr, pman, overlay, history); err != nil {
-			return err
-		}
-	} else {
-		if err := p.BuildXML(notif, pman, overlay); err != nil {
-			return err
+	if err := p.runPhase(notif, PhaseBuild, func(*Event) error {
+		if p.Type == PackageTypeYpkg {
+			return p.BuildYpkg(notif, usr, pman, overlay, history)
 		}
+		return p.BuildXML(notif, pman, overlay)
+	}); err != nil {
+		return err
 	}
 
-	return p.CollectAssets(overlay, usr, manifestTarget)
+	return p.runPhase(notif, PhaseCollectAssets, func(e *Event) error {
+		files, err := p.collectAssets(overlay, usr, manifestTarget, outputDir)
+		e.Data = &ArtifactsData{Files: files}
+		return err
+	})
 }
@@ -0,0 +1,271 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LatestLogName is the name of the symlink to the most recent log of a package
+	LatestLogName = "latest.log"
+
+	// LogSuffix is the suffix of all build logs
+	LogSuffix = ".log"
+
+	// logTimeFormat is the timestamp used for each line of a log
+	logTimeFormat = "2006-01-02 15:04:05.000"
+
+	// logNameTimeFormat is the timestamp used in the name of a log
+	logNameTimeFormat = "20060102-150405"
+)
+
+var (
+	// activeLog is the log that solbuild's own messages are copied to
+	activeLog     *BuildLog
+	activeLogLock sync.Mutex
+	logHookOnce   sync.Once
+)
+
+// A BuildLog is a persistent log of a single build, update or index run,
+// containing solbuild's own messages and all command output, each line with
+// a timestamp.
+type BuildLog struct {
+	Path string // Path to the log file
+
+	file    *os.File
+	lock    sync.Mutex
+	writers []*logLineWriter
+}
+
+// NewBuildLog will create a new log for the given package under the
+// configured log directory, i.e.:
+//
+//	/var/log/solbuild/main-x86_64/nano/5.4-120-20210301-101500.log
+//
+// The latest.log symlink for the package is updated to point to it, and old
+// logs are removed according to the configured retention.
+func NewBuildLog(config *Config, profile, name, version string, release int) (*BuildLog, error) {
+	dir := filepath.Join(config.LogDir, profile, name)
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return nil, err
+	}
+
+	stamp := time.Now().Format(logNameTimeFormat)
+	base := stamp
+	if version != "" {
+		base = fmt.Sprintf("%s-%d-%s", version, release, stamp)
+	}
+
+	// Don't clobber a log from the same second
+	var file *os.File
+	var err error
+	var logName string
+	for i := 0; ; i++ {
+		logName = base + LogSuffix
+		if i > 0 {
+			logName = fmt.Sprintf("%s.%d%s", base, i, LogSuffix)
+		}
+		file, err = os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 00644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	l := &BuildLog{
+		Path: filepath.Join(dir, logName),
+		file: file,
+	}
+
+	latest := filepath.Join(dir, LatestLogName)
+	os.Remove(latest)
+	if err := os.Symlink(logName, latest); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"link":  latest,
+		}).Warning("Failed to update latest log link")
+	}
+	pruneLogs(dir, config.LogRetention)
+
+	// Capture our own messages too
+	logHookOnce.Do(func() { log.AddHook(buildLogHook{}) })
+	activeLogLock.Lock()
+	activeLog = l
+	activeLogLock.Unlock()
+	return l, nil
+}
+
+// pruneLogs will remove all but the newest logs in the directory. A limit of
+// 0 or less will keep every log.
+func pruneLogs(dir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var logs []os.FileInfo
+	for _, f := range files {
+		if !f.Mode().IsRegular() || !strings.HasSuffix(f.Name(), LogSuffix) {
+			continue
+		}
+		logs = append(logs, f)
+	}
+	if len(logs) <= keep {
+		return
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].ModTime().After(logs[j].ModTime())
+	})
+	for _, f := range logs[keep:] {
+		path := filepath.Join(dir, f.Name())
+		if err := os.Remove(path); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"log":   path,
+			}).Warning("Failed to remove old build log")
+		}
+	}
+}
+
+// writeLine will write a single timestamped line to the log
+func (l *BuildLog) writeLine(line []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return
+	}
+	fmt.Fprintf(l.file, "[%s] %s\n", time.Now().Format(logTimeFormat), bytes.TrimRight(line, "\r\n"))
+}
+
+// Printf will write a formatted message to the log
+func (l *BuildLog) Printf(format string, v ...interface{}) {
+	l.writeLine([]byte(fmt.Sprintf(format, v...)))
+}
+
+// Writer will return a new writer for command output. Each stream of output
+// should have its own writer, so that partial lines aren't mixed up.
+func (l *BuildLog) Writer() io.Writer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	w := &logLineWriter{log: l}
+	l.writers = append(l.writers, w)
+	return w
+}
+
+// Close will flush any remaining output and close the log
+func (l *BuildLog) Close() error {
+	activeLogLock.Lock()
+	if activeLog == l {
+		activeLog = nil
+	}
+	activeLogLock.Unlock()
+
+	l.lock.Lock()
+	writers := l.writers
+	l.writers = nil
+	l.lock.Unlock()
+	for _, w := range writers {
+		w.flush()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// A logLineWriter splits output into lines to timestamp them in the log
+type logLineWriter struct {
+	log  *BuildLog
+	lock sync.Mutex
+	buf  []byte
+}
+
+// Write will log every complete line, holding onto any partial line until
+// the rest of it arrives.
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.writeLine(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush will write out any trailing partial line
+func (w *logLineWriter) flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		w.log.writeLine(w.buf)
+		w.buf = nil
+	}
+}
+
+// buildLogHook copies solbuild's own messages into the active build log
+type buildLogHook struct{}
+
+// Levels will return the levels we're interested in, i.e. all of them
+func (buildLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire will write the log entry to the active build log, if any
+func (buildLogHook) Fire(entry *log.Entry) error {
+	activeLogLock.Lock()
+	l := activeLog
+	activeLogLock.Unlock()
+	if l == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	msg := fmt.Sprintf("solbuild: %s %s", strings.ToUpper(entry.Level.String()), entry.Message)
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, entry.Data[k])
+	}
+	l.writeLine([]byte(msg))
+	return nil
+}
@@ -0,0 +1,74 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-log")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := &Config{LogDir: dir, LogRetention: 2}
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		l, err := NewBuildLog(config, "main-x86_64", "nano", "5.4", 120)
+		if err != nil {
+			t.Fatalf("Failed to create build log: %v", err)
+		}
+		w := l.Writer()
+		fmt.Fprintf(w, "first line\nsecond ")
+		fmt.Fprintf(w, "line\npartial")
+		if err = l.Close(); err != nil {
+			t.Fatalf("Failed to close build log: %v", err)
+		}
+		paths = append(paths, l.Path)
+	}
+
+	logDir := filepath.Join(dir, "main-x86_64", "nano")
+	target, err := os.Readlink(filepath.Join(logDir, LatestLogName))
+	if err != nil || target != filepath.Base(paths[2]) {
+		t.Fatalf("latest.log should point to the newest log, got: %v %v", target, err)
+	}
+	if !strings.HasPrefix(filepath.Base(paths[2]), "5.4-120-") {
+		t.Fatalf("Invalid log name: %s", paths[2])
+	}
+
+	b, err := ioutil.ReadFile(paths[2])
+	if err != nil {
+		t.Fatalf("Failed to read build log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], "] second line") || !strings.HasSuffix(lines[2], "] partial") {
+		t.Fatalf("Invalid build log contents:\n%s", b)
+	}
+
+	// Only the newest two remain, with the latest link
+	files, _ := ioutil.ReadDir(logDir)
+	if len(files) != 3 {
+		t.Fatalf("Expected 2 logs and a link after pruning, got %d files", len(files))
+	}
+}
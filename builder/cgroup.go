@@ -0,0 +1,358 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// CgroupRoot is where the unified cgroup v2 hierarchy is mounted
+	CgroupRoot = "/sys/fs/cgroup"
+
+	// CgroupParent is the cgroup containing all solbuild build cgroups
+	CgroupParent = "solbuild"
+
+	// cgroupCPUPeriod is the period used for CPU quotas, in microseconds
+	cgroupCPUPeriod = 100000
+
+	// cgroupMinCPUQuota is the smallest CPU quota the kernel accepts, in
+	// microseconds
+	cgroupMinCPUQuota = 1000
+)
+
+var (
+	// ErrNoCgroup2 is returned when the host doesn't use the unified hierarchy
+	ErrNoCgroup2 = errors.New("cgroup v2 is not available on this host")
+
+	memoryLimitPattern = regexp.MustCompile(`^(max|[0-9]+[KMGTkmgt]?)$`)
+
+	cgroups     = make(map[string]*Cgroup)
+	cgroupsLock sync.Mutex
+)
+
+// Limits define the resources available to the processes of a build
+type Limits struct {
+	Memory    string  `toml:"memory,omitempty"`    // Hard memory limit, i.e. "8G"
+	CPUWeight int     `toml:"cpu_weight,omitzero"` // Relative CPU weight, 1 to 10000
+	CPUs      float64 `toml:"cpus,omitzero"`       // Maximum number of CPUs worth of time
+	Pids      int     `toml:"pids,omitzero"`       // Maximum number of tasks
+}
+
+// IsSet will determine if any limit has been requested
+func (l Limits) IsSet() bool {
+	return l.Memory != "" || l.CPUWeight != 0 || l.CPUs != 0 || l.Pids != 0
+}
+
+// Merge will return a copy of the limits, overridden by any limits that have
+// been set in the other limits.
+func (l Limits) Merge(other Limits) Limits {
+	if other.Memory != "" {
+		l.Memory = other.Memory
+	}
+	if other.CPUWeight != 0 {
+		l.CPUWeight = other.CPUWeight
+	}
+	if other.CPUs != 0 {
+		l.CPUs = other.CPUs
+	}
+	if other.Pids != 0 {
+		l.Pids = other.Pids
+	}
+	return l
+}
+
+// Validate will ensure the limits are usable
+func (l Limits) Validate() error {
+	if l.Memory != "" && !memoryLimitPattern.MatchString(l.Memory) {
+		return fmt.Errorf("Invalid memory limit: %v", l.Memory)
+	}
+	if l.CPUWeight != 0 && (l.CPUWeight < 1 || l.CPUWeight > 10000) {
+		return fmt.Errorf("Invalid CPU weight: %v", l.CPUWeight)
+	}
+	if l.CPUs < 0 || (l.CPUs > 0 && l.CPUs*cgroupCPUPeriod < cgroupMinCPUQuota) {
+		return fmt.Errorf("Invalid CPU limit: %v, must be at least %v", l.CPUs, float64(cgroupMinCPUQuota)/cgroupCPUPeriod)
+	}
+	if l.Pids < 0 {
+		return fmt.Errorf("Invalid pids limit: %v", l.Pids)
+	}
+	return nil
+}
+
+// A Cgroup is a cgroup v2 leaf used to contain and account all processes of
+// a single build.
+type Cgroup struct {
+	Path string // Full path to the cgroup directory
+	Root string // The build root whose processes are placed in this cgroup
+}
+
+// CgroupUsage is the resource usage of a cgroup
+type CgroupUsage struct {
+	PeakMemory uint64        // Peak memory usage in bytes, if known
+	CPUTime    time.Duration // Total CPU time consumed
+	OOMKills   int           // Number of processes killed by the OOM killer
+}
+
+// IsCgroup2 will determine if the host uses the unified cgroup v2 hierarchy
+func IsCgroup2() bool {
+	return PathExists(filepath.Join(CgroupRoot, "cgroup.controllers"))
+}
+
+// writeCgroupFile will write the value to the given cgroup interface file
+func writeCgroupFile(path, value string) error {
+	return ioutil.WriteFile(path, []byte(value), 00644)
+}
+
+// enableControllers will attempt to delegate the controllers to the children
+// of the given cgroup, returning those that are now enabled.
+func enableControllers(dir string, controllers []string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, c := range controllers {
+		writeCgroupFile(filepath.Join(dir, "cgroup.subtree_control"), "+"+c)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return ret
+	}
+	for _, c := range strings.Fields(string(b)) {
+		ret[c] = true
+	}
+	return ret
+}
+
+// NewCgroup will create a new cgroup for the processes in the given build
+// root, with the limits applied.
+func NewCgroup(name, root string, limits Limits) (*Cgroup, error) {
+	if !IsCgroup2() {
+		return nil, ErrNoCgroup2
+	}
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+
+	parent := filepath.Join(CgroupRoot, CgroupParent)
+	if err := os.MkdirAll(parent, 00755); err != nil {
+		return nil, err
+	}
+	controllers := []string{"memory", "cpu", "pids"}
+	enableControllers(CgroupRoot, controllers)
+	enabled := enableControllers(parent, controllers)
+
+	cg := &Cgroup{
+		Path: filepath.Join(parent, name),
+		Root: root,
+	}
+
+	// Left behind by a build that was killed
+	if PathExists(cg.Path) {
+		cg.Kill()
+		if err := cg.Remove(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Mkdir(cg.Path, 00755); err != nil {
+		return nil, err
+	}
+
+	settings := []struct {
+		controller string
+		file       string
+		value      string
+	}{
+		{"memory", "memory.max", limits.Memory},
+		{"cpu", "cpu.weight", ""},
+		{"cpu", "cpu.max", ""},
+		{"pids", "pids.max", ""},
+	}
+	if limits.CPUWeight != 0 {
+		settings[1].value = strconv.Itoa(limits.CPUWeight)
+	}
+	if limits.CPUs != 0 {
+		settings[2].value = fmt.Sprintf("%d %d", int(limits.CPUs*cgroupCPUPeriod), cgroupCPUPeriod)
+	}
+	if limits.Pids != 0 {
+		settings[3].value = strconv.Itoa(limits.Pids)
+	}
+
+	for _, s := range settings {
+		if s.value == "" {
+			continue
+		}
+		if !enabled[s.controller] {
+			cg.Remove()
+			return nil, fmt.Errorf("cgroup controller %v is not available", s.controller)
+		}
+		if err := writeCgroupFile(filepath.Join(cg.Path, s.file), s.value); err != nil {
+			cg.Remove()
+			return nil, fmt.Errorf("Failed to set %v: %v", s.file, err)
+		}
+	}
+
+	cgroupsLock.Lock()
+	cgroups[root] = cg
+	cgroupsLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"cgroup":     cg.Path,
+		"memory":     limits.Memory,
+		"cpu_weight": limits.CPUWeight,
+		"cpus":       limits.CPUs,
+		"pids":       limits.Pids,
+	}).Debug("Created build cgroup")
+	return cg, nil
+}
+
+// cgroupFor will return the cgroup for the given build root, if any
+func cgroupFor(root string) *Cgroup {
+	cgroupsLock.Lock()
+	defer cgroupsLock.Unlock()
+	return cgroups[root]
+}
+
+// ProcsFile is the path used to move a process into the cgroup
+func (c *Cgroup) ProcsFile() string {
+	return filepath.Join(c.Path, "cgroup.procs")
+}
+
+// AddProcess will move the given process into the cgroup
+func (c *Cgroup) AddProcess(pid int) error {
+	return writeCgroupFile(c.ProcsFile(), strconv.Itoa(pid))
+}
+
+// Procs will return all processes currently in the cgroup
+func (c *Cgroup) Procs() []int {
+	var ret []int
+	b, err := ioutil.ReadFile(c.ProcsFile())
+	if err != nil {
+		return ret
+	}
+	for _, f := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			ret = append(ret, pid)
+		}
+	}
+	return ret
+}
+
+// Usage will return the resource usage of the cgroup so far
+func (c *Cgroup) Usage() CgroupUsage {
+	usage := CgroupUsage{}
+	if b, err := ioutil.ReadFile(filepath.Join(c.Path, "memory.peak")); err == nil {
+		usage.PeakMemory, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if v, ok := readCgroupKey(filepath.Join(c.Path, "cpu.stat"), "usage_usec"); ok {
+		usage.CPUTime = time.Duration(v) * time.Microsecond
+	}
+	if v, ok := readCgroupKey(filepath.Join(c.Path, "memory.events"), "oom_kill"); ok {
+		usage.OOMKills = int(v)
+	}
+	return usage
+}
+
+// readCgroupKey will read the named value from a flat keyed cgroup file
+func readCgroupKey(path, key string) (uint64, bool) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer fi.Close()
+	sc := bufio.NewScanner(fi)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+// Report will log the resource usage of the cgroup
+func (c *Cgroup) Report() {
+	usage := c.Usage()
+	fields := log.Fields{
+		"cpu_time": usage.CPUTime.Round(time.Millisecond),
+	}
+	if usage.PeakMemory > 0 {
+		fields["peak_memory"] = FormatBytes(usage.PeakMemory)
+	}
+	if usage.OOMKills > 0 {
+		fields["oom_kills"] = usage.OOMKills
+		log.WithFields(fields).Warning("Build resource usage, processes were killed for exceeding the memory limit")
+		return
+	}
+	log.WithFields(fields).Info("Build resource usage")
+}
+
+// Kill will kill every process within the cgroup
+func (c *Cgroup) Kill() {
+	if err := writeCgroupFile(filepath.Join(c.Path, "cgroup.kill"), "1"); err != nil {
+		// Older kernels, kill them one by one
+		for i := 0; i < 10 && len(c.Procs()) > 0; i++ {
+			for _, pid := range c.Procs() {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	// Processes take a moment to leave after dying
+	for i := 0; i < 50 && len(c.Procs()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Remove will remove the now empty cgroup
+func (c *Cgroup) Remove() error {
+	cgroupsLock.Lock()
+	if cgroups[c.Root] == c {
+		delete(cgroups, c.Root)
+	}
+	cgroupsLock.Unlock()
+
+	if !PathExists(c.Path) {
+		return nil
+	}
+	return os.Remove(c.Path)
+}
+
+// FormatBytes will return a human readable form of the given size
+func FormatBytes(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
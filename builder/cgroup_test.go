@@ -0,0 +1,48 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	config := Limits{Memory: "8G", CPUWeight: 100, Pids: 4096}
+	profile := Limits{Memory: "16G", CPUs: 2.5}
+
+	merged := config.Merge(profile)
+	if merged.Memory != "16G" || merged.CPUWeight != 100 || merged.CPUs != 2.5 || merged.Pids != 4096 {
+		t.Fatalf("Invalid merged limits: %+v", merged)
+	}
+	if err := merged.Validate(); err != nil {
+		t.Fatalf("Valid limits failed validation: %v", err)
+	}
+	if err := (Limits{CPUs: 0.01}).Validate(); err != nil {
+		t.Fatalf("Smallest CPU limit failed validation: %v", err)
+	}
+	if (Limits{}).IsSet() {
+		t.Fatal("Empty limits should not be set")
+	}
+	for _, l := range []Limits{{Memory: "8 gigs"}, {CPUWeight: 20000}, {CPUs: -1}, {CPUs: 0.005}, {Pids: -1}} {
+		if err := l.Validate(); err == nil {
+			t.Fatalf("Invalid limits passed validation: %+v", l)
+		}
+	}
+	if s := FormatBytes(3 * 1024 * 1024 * 1024 / 2); s != "1.5 GiB" {
+		t.Fatalf("Invalid formatted size: %s", s)
+	}
+}
@@ -53,7 +53,7 @@ func (p *Package) Chroot(notif PidNotifier, pman *EopkgManager, overlay *Overlay
 			}
 
 			// Ensure the overlay can network on localhost only
-			if err := overlay.ConfigureNetworking(); err != nil {
+			if err := overlay.ConfigureNetworking(notif); err != nil {
 				return err
 			}
 		} else {
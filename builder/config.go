@@ -17,11 +17,14 @@
 package builder
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 )
 
 // Config defines the global defaults for solbuild
@@ -30,6 +33,21 @@ type Config struct {
 	EnableTmpfs    bool   `toml:"enable_tmpfs"`     // Whether to enable tmpfs builds or
 	OverlayRootDir string `toml:"overlay_root_dir"` // Custom Overlay Root Dir
 	TmpfsSize      string `toml:"tmpfs_size"`       // Bounding size on the tmpfs
+	BuildTimeout   string `toml:"build_timeout"`    // Default time limit for builds, i.e. "4h"
+	OutputDir      string `toml:"output_dir"`       // Where built packages are stored, empty for the working directory
+	PublishRetain  int    `toml:"publish_retain"`   // Number of releases to keep in local repos when publishing, 0 for all
+	LogDir         string `toml:"log_dir"`          // Where build logs are stored, empty to disable
+	LogRetention   int    `toml:"log_retention"`    // Number of logs to keep per package, 0 for all
+	Limits         Limits `toml:"limits"`           // Resource limits for builds
+
+	Sources map[string]string `toml:"-"` // File each key was last set by
+}
+
+// A ConfigValue is a single key of the merged configuration
+type ConfigValue struct {
+	Key    string // Full key, i.e. "limits.memory"
+	Value  string // Value in TOML syntax
+	Source string // File that set the value, empty for a default
 }
 
 var (
@@ -52,8 +70,14 @@ func NewConfig() (*Config, error) {
 		EnableTmpfs:    false,
 		OverlayRootDir: "/var/cache/solbuild",
 		TmpfsSize:      "",
+		LogDir:         "/var/log/solbuild",
+		LogRetention:   10,
+		PublishRetain:  1,
+		Sources:        make(map[string]string),
 	}
 
+	var errs ConfigErrors
+
 	// Reverse because /etc takes precedence in stateless
 	for i := len(ConfigPaths) - 1; i >= 0; i-- {
 		globPat := filepath.Join(ConfigPaths[i], fmt.Sprintf("*%s", ConfigSuffix))
@@ -79,10 +103,69 @@ func NewConfig() (*Config, error) {
 			}
 			fi.Close()
 
-			if _, err = toml.Decode(string(b), config); err != nil {
+			// Carry on to report the problems in every file at once
+			md, err := decodeConfigFile(p, b, config)
+			switch e := err.(type) {
+			case nil:
+			case ConfigErrors:
+				errs = append(errs, e...)
+			case *ConfigError:
+				errs = append(errs, e)
+				continue
+			default:
 				return nil, err
 			}
+			for _, key := range md.Keys() {
+				config.Sources[key.String()] = p
+			}
 		}
 	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
+
+// flattenConfig will add each leaf of the decoded TOML table to values
+func flattenConfig(prefix string, table map[string]interface{}, values map[string]string) {
+	for key, value := range table {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(key, v, values)
+		case string:
+			values[key] = strconv.Quote(v)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Values will return every key of the configuration, sorted by key, along
+// with the file that set it.
+func (c *Config) Values() ([]ConfigValue, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	table := make(map[string]interface{})
+	if _, err := toml.Decode(buf.String(), &table); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]string)
+	flattenConfig("", table, flat)
+
+	var values []ConfigValue
+	for key, value := range flat {
+		values = append(values, ConfigValue{Key: key, Value: value, Source: c.Sources[key]})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	return values, nil
+}
@@ -0,0 +1,81 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withConfigPaths will replace the system paths with the given files, laid
+// out in the same order, until the returned function is called.
+func withConfigPaths(t *testing.T, files ...map[string]string) func() {
+	dir, err := ioutil.TempDir("", "solbuild-config")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	saved := ConfigPaths
+	ConfigPaths = nil
+	for i, layer := range files {
+		path := filepath.Join(dir, string('a'+rune(i)))
+		if err = os.Mkdir(path, 00755); err != nil {
+			t.Fatalf("Failed to create config path: %v", err)
+		}
+		for name, content := range layer {
+			if err = ioutil.WriteFile(filepath.Join(path, name), []byte(content), 00644); err != nil {
+				t.Fatalf("Failed to write %s: %v", name, err)
+			}
+		}
+		ConfigPaths = append(ConfigPaths, path)
+	}
+	return func() {
+		ConfigPaths = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	defer withConfigPaths(t,
+		map[string]string{"local.conf": "default_profile = \"local\"\n[limits]\nmemory = \"4G\"\n"},
+		map[string]string{"solbuild.conf": "default_profile = \"main-x86_64\"\nlog_retention = 5\n"},
+	)()
+	config, err := NewConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	values, err := config.Values()
+	if err != nil {
+		t.Fatalf("Failed to list config values: %v", err)
+	}
+	sources := make(map[string]ConfigValue)
+	for _, v := range values {
+		sources[v.Key] = v
+	}
+	for key, want := range map[string]ConfigValue{
+		"default_profile": {Value: `"local"`, Source: filepath.Join(ConfigPaths[0], "local.conf")},
+		"limits.memory":   {Value: `"4G"`, Source: filepath.Join(ConfigPaths[0], "local.conf")},
+		"log_retention":   {Value: "5", Source: filepath.Join(ConfigPaths[1], "solbuild.conf")},
+		"publish_retain":  {Value: "1"},
+	} {
+		got := sources[key]
+		if got.Value != want.Value || got.Source != want.Source {
+			t.Fatalf("Invalid %s: %+v", key, got)
+		}
+	}
+}
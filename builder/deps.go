@@ -0,0 +1,176 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"github.com/getsolus/libosdev/disk"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxSuggestions is the most alternatives offered for a missing dependency
+	maxSuggestions = 5
+)
+
+var (
+	// ErrUnresolvedDeps is returned when the build dependencies of a package
+	// cannot be found in any repository of the profile
+	ErrUnresolvedDeps = errors.New("Build dependencies cannot be resolved")
+)
+
+// An UnresolvedDep is a build dependency that no repository provides
+type UnresolvedDep struct {
+	Dep         string   // The dependency as written in package.yml
+	Suggestions []string // Alternatives that do exist, if any
+}
+
+// depQuery will return the Query used to resolve a build dependency, which is
+// either a pkgconfig provider or the exact name of a package.
+func depQuery(dep string) *Query {
+	if q := ParseQuery(dep); q.Kind == QueryPkgConfig || q.Kind == QueryPkgConfig32 {
+		return q
+	}
+	return &Query{Kind: QueryPackage, Term: dep}
+}
+
+// ResolveDeps will look up each build dependency in the sources, returning
+// those that cannot be found along with suggested alternatives.
+func ResolveDeps(sources []*QuerySource, deps []string) ([]*UnresolvedDep, error) {
+	var unresolved []*UnresolvedDep
+	for _, dep := range deps {
+		q := depQuery(dep)
+		results, err := RunQuery(sources, q)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			continue
+		}
+		suggestions, err := suggestDeps(sources, q)
+		if err != nil {
+			return nil, err
+		}
+		unresolved = append(unresolved, &UnresolvedDep{Dep: dep, Suggestions: suggestions})
+	}
+	return unresolved, nil
+}
+
+// suggestDeps will find alternatives to a missing dependency. A pkgconfig
+// provider may only exist in the other architecture, otherwise packages with
+// a similar name are suggested.
+func suggestDeps(sources []*QuerySource, q *Query) ([]string, error) {
+	var suggestions []string
+	switch q.Kind {
+	case QueryPkgConfig, QueryPkgConfig32:
+		other := &Query{Kind: QueryPkgConfig32, Term: q.Term}
+		if q.Kind == QueryPkgConfig32 {
+			other.Kind = QueryPkgConfig
+		}
+		results, err := RunQuery(sources, other)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			suggestions = append(suggestions, other.String())
+		}
+	}
+
+	// i.e. zlib-32bit-devel should suggest zlib-devel
+	stem := strings.TrimSuffix(strings.TrimSuffix(q.Term, "-devel"), "-32bit")
+	results, err := RunQuery(sources, &Query{Kind: QueryName, Term: stem})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, r := range results {
+		if !seen[r.Package] && strings.Contains(r.Package, stem) {
+			seen[r.Package] = true
+			names = append(names, r.Package)
+		}
+	}
+	// Shorter names are usually the closest match
+	sort.SliceStable(names, func(i, j int) bool {
+		return len(names[i]) < len(names[j])
+	})
+	for _, name := range names {
+		if len(suggestions) >= maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, name)
+	}
+	return suggestions, nil
+}
+
+// depsCertain will determine whether a dependency missing from the indexes
+// on the host is certainly missing. The remote repos added by a profile can't
+// be seen at all, so they may still provide it.
+func (p *Profile) depsCertain() bool {
+	for _, repo := range p.ReposToAdd() {
+		if !repo.Local {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDeps will resolve the build dependencies of the package against the
+// repository indexes of the profile on the host, so that a missing dependency
+// is reported before the build root is brought up.
+func (m *Manager) checkDeps() (*DepsData, error) {
+	data := &DepsData{Checked: m.pkg.BuildDeps}
+	if m.pkg.Type != PackageTypeYpkg || len(m.pkg.BuildDeps) == 0 {
+		return data, nil
+	}
+
+	// The overlay is locked by the build, so its image dir is ours until the
+	// build root is brought up
+	if err := m.image.mountReadOnly(m.overlay.ImgDir); err != nil {
+		return data, err
+	}
+	defer disk.GetMountManager().Unmount(m.overlay.ImgDir)
+
+	unresolved, err := ResolveDeps(m.profile.QuerySources(m.overlay.ImgDir), m.pkg.BuildDeps)
+	if err != nil {
+		return data, err
+	}
+	if len(unresolved) == 0 {
+		return data, nil
+	}
+
+	for _, u := range unresolved {
+		data.Unresolved = append(data.Unresolved, u.Dep)
+		fields := log.Fields{
+			"dependency": u.Dep,
+		}
+		if len(u.Suggestions) > 0 {
+			fields["suggestions"] = strings.Join(u.Suggestions, ", ")
+		}
+		log.WithFields(fields).Error("Unresolvable build dependency")
+	}
+
+	if !m.profile.depsCertain() {
+		log.WithFields(log.Fields{
+			"profile": m.profile.Name,
+		}).Warning("Profile adds remote repositories, they may provide the missing dependencies")
+		return data, nil
+	}
+	return data, ErrUnresolvedDeps
+}
@@ -18,7 +18,6 @@ package builder
 
 import (
 	"fmt"
-	"github.com/getsolus/libosdev/commands"
 	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
@@ -185,7 +184,8 @@ func (e *EopkgManager) StopDBUS() error {
 	}
 
 	pid := strings.Split(string(b), "\n")[0]
-	return commands.ExecStdoutArgs("kill", []string{"-9", pid})
+	// The PID is relative to the PID namespace of the root
+	return killInRoot(e.notif, e.root, pid)
 }
 
 // Cleanup will take care of any work we've already done before
@@ -322,6 +322,28 @@ func (e *EopkgManager) AddRepo(id, source string) error {
 	return ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg add-repo '%s' '%s'", id, source)))
 }
 
+// AddRepoAt will attempt to add a repo to the filesystem at the given position
+// in the repo order, where 0 is first. A negative position appends the repo.
+func (e *EopkgManager) AddRepoAt(id, source string, pos int) error {
+	if pos < 0 {
+		return e.AddRepo(id, source)
+	}
+	e.notif.SetActivePID(0)
+	return ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg add-repo --at %d '%s' '%s'", pos, id, source)))
+}
+
+// InstallPackages will install the given packages inside the chroot, which
+// may be names or paths to .eopkg files within the chroot.
+func (e *EopkgManager) InstallPackages(pkgs []string) error {
+	quoted := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		quoted[i] = fmt.Sprintf("'%s'", pkg)
+	}
+	err := ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg install -y %s", strings.Join(quoted, " "))))
+	e.notif.SetActivePID(0)
+	return err
+}
+
 // RemoveRepo will attempt to remove a named repo from the filesystem
 func (e *EopkgManager) RemoveRepo(id string) error {
 	e.notif.SetActivePID(0)
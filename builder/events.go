@@ -0,0 +1,241 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"time"
+)
+
+// A Phase is a single step in the build of a package
+type Phase string
+
+const (
+	// PhaseClean removes any stale workspace left by a previous build
+	PhaseClean Phase = "clean"
+
+	// PhaseActivateRoot mounts the overlay and brings up the build root
+	PhaseActivateRoot Phase = "activate-root"
+
+	// PhaseCopyAssets copies the package files into the build root
+	PhaseCopyAssets Phase = "copy-assets"
+
+	// PhaseFetchSources fetches any sources not already in the cache
+	PhaseFetchSources Phase = "fetch-sources"
+
+	// PhaseInitPackageManager prepares eopkg within the build root
+	PhaseInitPackageManager Phase = "init-package-manager"
+
+	// PhaseStartDBUS brings up the system bus within the build root
+	PhaseStartDBUS Phase = "start-dbus"
+
+	// PhaseConfigureRepos sets up the repositories requested by the profile
+	PhaseConfigureRepos Phase = "configure-repos"
+
+	// PhaseUpgrade upgrades the packages in the build root
+	PhaseUpgrade Phase = "upgrade"
+
+	// PhaseInstallComponent installs the base development component
+	PhaseInstallComponent Phase = "install-component"
+
+	// PhaseCreateDirs creates the working directories for the build
+	PhaseCreateDirs Phase = "create-dirs"
+
+	// PhaseBuild runs the actual package build
+	PhaseBuild Phase = "build"
+
+	// PhaseCollectAssets copies the resulting files out of the build root
+	PhaseCollectAssets Phase = "collect-assets"
+
+	// PhasePublish copies the built packages into a local repo, when requested.
+	// It is not included in BuildPhases as it is optional.
+	PhasePublish Phase = "publish"
+
+	// PhaseCheckDeps resolves the build dependencies against the repository
+	// indexes on the host, before the build root is brought up. It is not
+	// included in BuildPhases as it may be skipped.
+	PhaseCheckDeps Phase = "check-deps"
+)
+
+// BuildPhases is every Phase of a build, in the order they are run
+var BuildPhases = []Phase{
+	PhaseClean,
+	PhaseActivateRoot,
+	PhaseCopyAssets,
+	PhaseFetchSources,
+	PhaseInitPackageManager,
+	PhaseStartDBUS,
+	PhaseConfigureRepos,
+	PhaseUpgrade,
+	PhaseInstallComponent,
+	PhaseCreateDirs,
+	PhaseBuild,
+	PhaseCollectAssets,
+}
+
+// phaseDescriptions are human readable forms of each Phase
+var phaseDescriptions = map[Phase]string{
+	PhaseClean:              "Cleaning workspace",
+	PhaseActivateRoot:       "Activating build root",
+	PhaseCopyAssets:         "Copying package assets",
+	PhaseFetchSources:       "Fetching sources",
+	PhaseInitPackageManager: "Initialising package manager",
+	PhaseStartDBUS:          "Starting D-BUS",
+	PhaseConfigureRepos:     "Configuring repositories",
+	PhaseUpgrade:            "Upgrading system base",
+	PhaseInstallComponent:   "Installing build dependencies",
+	PhaseCreateDirs:         "Creating build directories",
+	PhaseBuild:              "Building package",
+	PhaseCollectAssets:      "Collecting build artifacts",
+	PhasePublish:            "Publishing to local repository",
+	PhaseCheckDeps:          "Checking build dependencies",
+}
+
+// Description will return a human readable description of the Phase
+func (p Phase) Description() string {
+	if desc, ok := phaseDescriptions[p]; ok {
+		return desc
+	}
+	return string(p)
+}
+
+// Index will return the position of the Phase within BuildPhases, starting
+// at 1, or 0 if it isn't a build phase.
+func (p Phase) Index() int {
+	for i, phase := range BuildPhases {
+		if phase == p {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// An EventKind is the type of an Event
+type EventKind string
+
+const (
+	// EventBuildStarted is sent once the build root is locked and the build begins
+	EventBuildStarted EventKind = "build-started"
+
+	// EventBuildFinished is sent when the build has completed, successfully or not
+	EventBuildFinished EventKind = "build-finished"
+
+	// EventPhaseStarted is sent as each Phase of the build begins
+	EventPhaseStarted EventKind = "phase-started"
+
+	// EventPhaseFinished is sent as each Phase of the build completes
+	EventPhaseFinished EventKind = "phase-finished"
+)
+
+// An Event describes progress through a build
+type Event struct {
+	Kind     EventKind     // What kind of event this is
+	Phase    Phase         // The Phase this event relates to, if any
+	Package  string        // Name of the package being built
+	Time     time.Time     // When the event happened
+	Duration time.Duration // How long the build or Phase took, for finish events
+	Error    error         // Why the build or Phase failed, for finish events
+
+	// Data holds any extra information about the Phase on finish events, i.e.
+	// *SourcesData, *ReposData, *ComponentData, *ArtifactsData or *PublishData.
+	// It may be nil.
+	Data interface{}
+}
+
+// SourcesData is attached to events for PhaseFetchSources
+type SourcesData struct {
+	Fetched []string // Sources downloaded during this build
+	Cached  []string // Sources already present in the cache
+}
+
+// ReposData is attached to events for PhaseConfigureRepos
+type ReposData struct {
+	Removed []string // Repositories removed from the build root
+	Added   []string // Repositories added to the build root
+	Pinned  []string // Packages installed or held due to a pin
+}
+
+// ComponentData is attached to events for PhaseInstallComponent
+type ComponentData struct {
+	Component string // The component that was installed
+}
+
+// ArtifactsData is attached to events for PhaseCollectAssets
+type ArtifactsData struct {
+	Files []string // Paths of the files collected from the build
+}
+
+// PublishData is attached to events for PhasePublish
+type PublishData struct {
+	Repo      string   // Name of the local repo published to
+	Published []string // Paths of the packages added to the repo
+	Removed   []string // Paths of older releases removed from the repo
+}
+
+// DepsData is attached to events for PhaseCheckDeps
+type DepsData struct {
+	Checked    []string // Build dependencies that were looked up
+	Unresolved []string // Build dependencies no repository provides
+}
+
+// An Observer is notified of every Event during a build. Events are delivered
+// synchronously from the building goroutine, so observers should not block.
+type Observer interface {
+	Notify(e *Event)
+}
+
+// ObserverFunc allows a plain function to be used as an Observer
+type ObserverFunc func(e *Event)
+
+// Notify will call the function with the event
+func (f ObserverFunc) Notify(e *Event) {
+	f(e)
+}
+
+// An EventEmitter is a PidNotifier that wants to know about build events
+type EventEmitter interface {
+	Emit(e *Event)
+}
+
+// emit will send the event on to the notifier, if it wants events
+func emit(notif PidNotifier, e *Event) {
+	if emitter, ok := notif.(EventEmitter); ok {
+		emitter.Emit(e)
+	}
+}
+
+// runPhase will run a single Phase of the package build, sending events as it
+// starts and finishes. fn may attach extra data to the finish event.
+func (p *Package) runPhase(notif PidNotifier, phase Phase, fn func(e *Event) error) error {
+	start := time.Now()
+	emit(notif, &Event{
+		Kind:    EventPhaseStarted,
+		Phase:   phase,
+		Package: p.Name,
+		Time:    start,
+	})
+	e := &Event{
+		Kind:    EventPhaseFinished,
+		Phase:   phase,
+		Package: p.Name,
+	}
+	err := fn(e)
+	e.Time = time.Now()
+	e.Duration = e.Time.Sub(start)
+	e.Error = err
+	emit(notif, e)
+	return err
+}
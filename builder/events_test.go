@@ -0,0 +1,65 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"testing"
+)
+
+type eventRecorder struct {
+	events []*Event
+}
+
+func (r *eventRecorder) SetActivePID(int) {}
+
+func (r *eventRecorder) Emit(e *Event) {
+	r.events = append(r.events, e)
+}
+
+func TestRunPhase(t *testing.T) {
+	rec := &eventRecorder{}
+	pkg := &Package{Name: "nano"}
+	failed := errors.New("no network")
+
+	err := pkg.runPhase(rec, PhaseFetchSources, func(e *Event) error {
+		e.Data = &SourcesData{Fetched: []string{"nano-5.4.tar.xz"}}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("runPhase should return the phase error, got: %v", err)
+	}
+	if len(rec.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(rec.events))
+	}
+	start, end := rec.events[0], rec.events[1]
+	if start.Kind != EventPhaseStarted || end.Kind != EventPhaseFinished {
+		t.Fatalf("Invalid event kinds: %s, %s", start.Kind, end.Kind)
+	}
+	if end.Phase != PhaseFetchSources || end.Package != "nano" || end.Error != failed {
+		t.Fatalf("Invalid finish event: %+v", end)
+	}
+	if data, ok := end.Data.(*SourcesData); !ok || len(data.Fetched) != 1 {
+		t.Fatalf("Finish event is missing phase data: %+v", end.Data)
+	}
+	if end.Time.Before(start.Time) || end.Duration != end.Time.Sub(start.Time) {
+		t.Fatalf("Invalid event timing: %s -> %s (%s)", start.Time, end.Time, end.Duration)
+	}
+	if PhaseFetchSources.Index() != 4 || Phase("bogus").Index() != 0 {
+		t.Fatalf("Invalid phase index")
+	}
+}
@@ -17,82 +17,505 @@
 package builder
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
-	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// IndexFile is the name of the uncompressed repository index
+	IndexFile = "eopkg-index.xml"
+
+	// IndexXZFile is the name of the compressed repository index
+	IndexXZFile = IndexFile + ".xz"
+
+	// IndexSha1Suffix is appended to the name of each index to form the name
+	// of the file holding its sha1sum.
+	IndexSha1Suffix = ".sha1sum"
+
+	// IndexLockName is the name of the lock file used while indexing
+	IndexLockName = ".solbuild-index.lock"
+
+	// MetadataFile is the file within each eopkg describing the package
+	MetadataFile = "metadata.xml"
 )
 
 var (
 	// ErrCannotContinue is a stock error return
 	ErrCannotContinue = errors.New("Index cannot continue")
 
-	// IndexBindTarget is where we always mount the repo
-	IndexBindTarget = "/hostRepo/Index"
+	// deltaNameRegex splits name-from-to-build-arch.delta.eopkg
+	deltaNameRegex = regexp.MustCompile(`^(.+)-([0-9]+)-([0-9]+)-([0-9]+)-([^-]+)\.delta\.eopkg$`)
 )
 
-// Index will attempt to index the given directory
-func (p *Package) Index(notif PidNotifier, dir string, overlay *Overlay) error {
-	log.WithFields(log.Fields{
-		"profile": overlay.Back.Name,
-	}).Debug("Beginning indexer")
+// indexPackager is the packager of the source in metadata.xml
+type indexPackager struct {
+	Name  string `xml:"Name"`
+	Email string `xml:"Email"`
+}
 
-	mman := disk.GetMountManager()
+// indexSource is the subset of the metadata.xml source carried into the index
+type indexSource struct {
+	Name     string         `xml:"Name"`
+	Homepage string         `xml:"Homepage,omitempty"`
+	Packager *indexPackager `xml:"Packager,omitempty"`
+}
 
-	ChrootEnvironment = SaneEnvironment("root", "/root")
+// indexUpdate is a single entry in the package history
+type indexUpdate struct {
+	Release int `xml:"release,attr"`
+}
 
-	// Check the source exists first!
-	if !PathExists(dir) {
-		log.WithFields(log.Fields{
-			"dir": dir,
-		}).Error("Directory does not exist")
-		return ErrCannotContinue
+// eopkgMetadata is the metadata.xml found within each eopkg. The package
+// itself is carried into the index verbatim.
+type eopkgMetadata struct {
+	Source  indexSource `xml:"Source"`
+	Package struct {
+		Name         string        `xml:"Name"`
+		Architecture string        `xml:"Architecture"`
+		Updates      []indexUpdate `xml:"History>Update"`
+		Inner        string        `xml:",innerxml"`
+	} `xml:"Package"`
+}
+
+// indexDelta is a delta package from an older release
+type indexDelta struct {
+	ReleaseFrom int    `xml:"releaseFrom,attr"`
+	PackageURI  string `xml:"PackageURI"`
+	PackageSize int64  `xml:"PackageSize"`
+	PackageHash string `xml:"PackageHash"`
+}
+
+// indexExtra is added to the package metadata within the index
+type indexExtra struct {
+	XMLName       xml.Name     `xml:"Package"`
+	PackageURI    string       `xml:"PackageURI"`
+	PackageSize   int64        `xml:"PackageSize"`
+	PackageHash   string       `xml:"PackageHash"`
+	DeltaPackages *indexDeltas `xml:"DeltaPackages,omitempty"`
+	Source        indexSource  `xml:"Source"`
+}
+
+// indexDeltas wraps the deltas so they are omitted entirely when empty
+type indexDeltas struct {
+	Deltas []*indexDelta `xml:"Delta"`
+}
+
+// indexEntry is a single package within the index
+type indexEntry struct {
+	meta    *eopkgMetadata
+	release int
+	uri     string
+	size    int64
+	hash    string
+	deltas  []*indexDelta
+}
+
+// key will return the identity of the package within the index
+func (e *indexEntry) key() string {
+	return e.meta.Package.Name + "/" + e.meta.Package.Architecture
+}
+
+// IndexLockPath will return the path of the lock file for indexing dir
+func IndexLockPath(dir string) string {
+	return filepath.Join(dir, IndexLockName)
+}
+
+// readMetadata will read the raw metadata.xml from within the eopkg
+func readMetadata(path string) ([]byte, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
 	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name != MetadataFile {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("%s is missing", MetadataFile)
+}
+
+// parseMetadata will parse the raw metadata.xml of an eopkg
+func parseMetadata(b []byte) (*eopkgMetadata, error) {
+	meta := &eopkgMetadata{}
+	if err := xml.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	if meta.Package.Name == "" {
+		return nil, fmt.Errorf("%s has no package name", MetadataFile)
+	}
+	return meta, nil
+}
 
-	// Indexer will always create new dirs..
-	if err := overlay.CleanExisting(); err != nil {
+// newIndexEntry will gather everything needed to index the eopkg at path,
+// found at uri relative to the repository. The package is only read if it
+// isn't already in the cache.
+func newIndexEntry(path, uri string, info os.FileInfo, cache *IndexCache) (*indexEntry, error) {
+	cached := cache.lookup(uri, info)
+	if cached == nil || cached.Metadata == nil {
+		raw, err := readMetadata(path)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := FileSha1sum(path)
+		if err != nil {
+			return nil, err
+		}
+		cached = newIndexCacheEntry(info, hash, raw)
+	}
+	meta, err := parseMetadata(cached.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	cache.keep(uri, cached)
+
+	entry := &indexEntry{
+		meta: meta,
+		uri:  uri,
+		size: info.Size(),
+		hash: cached.Hash,
+	}
+	// Newest update comes first
+	if len(meta.Package.Updates) > 0 {
+		entry.release = meta.Package.Updates[0].Release
+	}
+	return entry, nil
+}
+
+// writeXML will write the entry as a <Package> within the index
+func (e *indexEntry) writeXML(buf *bytes.Buffer) error {
+	buf.WriteString("    <Package>\n        ")
+	buf.WriteString(strings.TrimSpace(e.meta.Package.Inner))
+	buf.WriteString("\n")
+
+	extra := &indexExtra{
+		PackageURI:  e.uri,
+		PackageSize: e.size,
+		PackageHash: e.hash,
+		Source:      e.meta.Source,
+	}
+	if len(e.deltas) > 0 {
+		extra.DeltaPackages = &indexDeltas{Deltas: e.deltas}
+	}
+
+	b, err := xml.MarshalIndent(extra, "    ", "    ")
+	if err != nil {
 		return err
 	}
+	// Strip the wrapping element, we only want the children
+	lines := strings.Split(string(b), "\n")
+	for _, line := range lines[1 : len(lines)-1] {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("    </Package>\n")
+	return nil
+}
 
-	if err := p.ActivateRoot(overlay); err != nil {
+// writeIndexFile will atomically write the file along with its sha1sum
+func writeIndexFile(path string, data []byte) error {
+	tmp := path + ".part"
+	if err := ioutil.WriteFile(tmp, data, 00644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
 		return err
 	}
+	hash, err := FileSha1sum(path)
+	if err != nil {
+		return err
+	}
+	sumPath := path + IndexSha1Suffix
+	if err = ioutil.WriteFile(sumPath+".part", []byte(hash), 00644); err != nil {
+		return err
+	}
+	return os.Rename(sumPath+".part", sumPath)
+}
 
-	// Create the target
-	target := filepath.Join(overlay.MountPoint, IndexBindTarget[1:])
-	if err := os.MkdirAll(target, 00755); err != nil {
-		log.WithFields(log.Fields{
-			"dir":   target,
-			"error": err,
-		}).Error("Cannot create bind target")
+// IndexDir will generate the eopkg index for all packages within the
+// directory, without needing a build root. Only the newest release of each
+// package is indexed, along with any deltas to it. Packages that haven't
+// changed since the last run are taken from the index cache instead of being
+// read again. If a signing key is given, the index is signed with it, otherwise
+// any old signatures are removed. The caller is responsible for holding the
+// index lock.
+func IndexDir(ctx context.Context, dir, signingKey string) error {
+	if err := checkIndexDir(dir); err != nil {
 		return err
 	}
 
 	log.WithFields(log.Fields{
 		"dir": dir,
-	}).Debug("Bind mounting directory for indexing")
+	}).Debug("Beginning indexer")
 
-	if err := mman.BindMount(dir, target); err != nil {
-		log.WithFields(log.Fields{
-			"dir":   target,
-			"error": err,
-		}).Error("Cannot bind mount directory")
+	cache := LoadIndexCache(dir)
+	entries := make(map[string]*indexEntry)
+	var deltas []string
+	deltaInfo := make(map[string]os.FileInfo)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ErrInterrupted
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if strings.HasSuffix(name, DeltaSuffix) {
+			deltas = append(deltas, path)
+			deltaInfo[path] = info
+			return nil
+		}
+		if !strings.HasSuffix(name, EopkgSuffix) {
+			return nil
+		}
+		uri, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry, err := newIndexEntry(path, uri, info, cache)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  uri,
+				"error": err,
+			}).Error("Failed to read package")
+			return err
+		}
+		if prev, ok := entries[entry.key()]; ok && prev.release > entry.release {
+			return nil
+		}
+		entries[entry.key()] = entry
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	// Ensure it gets cleaned up
-	overlay.ExtraMounts = append(overlay.ExtraMounts, target)
+	// Attach deltas to the release they upgrade to
+	for _, path := range deltas {
+		match := deltaNameRegex.FindStringSubmatch(filepath.Base(path))
+		if match == nil {
+			continue
+		}
+		entry, ok := entries[match[1]+"/"+match[5]]
+		if !ok {
+			continue
+		}
+		from, _ := strconv.Atoi(match[2])
+		to, _ := strconv.Atoi(match[3])
+		if to != entry.release {
+			continue
+		}
+		uri, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info := deltaInfo[path]
+		hash, err := cache.fileHash(path, uri, info)
+		if err != nil {
+			return err
+		}
+		entry.deltas = append(entry.deltas, &indexDelta{
+			ReleaseFrom: from,
+			PackageURI:  uri,
+			PackageSize: info.Size(),
+			PackageHash: hash,
+		})
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	log.Debug("Now indexing")
-	command := fmt.Sprintf("cd %s; %s", IndexBindTarget, eopkgCommand("eopkg index --skip-signing ."))
-	if err := ChrootExec(notif, overlay.MountPoint, command); err != nil {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<PISI>\n")
+	for _, key := range keys {
+		entry := entries[key]
+		sort.Slice(entry.deltas, func(i, j int) bool {
+			return entry.deltas[i].ReleaseFrom > entry.deltas[j].ReleaseFrom
+		})
+		if err := entry.writeXML(&buf); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("</PISI>\n")
+
+	var xzBuf bytes.Buffer
+	w, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	if err = writeIndexFile(filepath.Join(dir, IndexFile), buf.Bytes()); err != nil {
+		return err
+	}
+	if err = writeIndexFile(filepath.Join(dir, IndexXZFile), xzBuf.Bytes()); err != nil {
+		return err
+	}
+	if err = SignIndex(dir, signingKey); err != nil {
+		return err
+	}
+
+	// The index is fine without it, it'll just be slower next time
+	if err = cache.Save(); err != nil {
 		log.WithFields(log.Fields{
-			"error": err,
 			"dir":   dir,
-		}).Error("Indexing failed")
-		return err
+			"error": err,
+		}).Warning("Failed to save index cache")
 	}
+
+	log.WithFields(log.Fields{
+		"dir":      dir,
+		"packages": len(entries),
+		"cached":   cache.hits,
+	}).Debug("Wrote index")
 	return nil
 }
+
+// checkIndexDir will ensure the directory to index exists. It must be checked
+// before taking the index lock, as that would create the directory.
+func checkIndexDir(dir string) error {
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		log.WithFields(log.Fields{
+			"dir": dir,
+		}).Error("Directory does not exist")
+		return ErrCannotContinue
+	}
+	return nil
+}
+
+// LockRepo will wait for any other process changing or indexing the repo in
+// the directory, returning a function to release the lock once we're done.
+// The index must then be written with IndexDir, rather than IndexRepo.
+func LockRepo(ctx context.Context, dir, operation string) (func(), error) {
+	lock, err := NewLockFile(IndexLockPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	lock.SetInfo(&LockInfo{
+		Operation: operation,
+		Started:   time.Now().UTC(),
+		User:      lockUser(),
+	})
+	if err = lock.LockWait(ctx, 0, func() {
+		log.WithFields(log.Fields{
+			"dir": dir,
+			"pid": lock.GetOwnerPID(),
+		}).Info("Waiting for another process to finish with the repository")
+	}); err != nil {
+		return nil, err
+	}
+	return func() {
+		lock.Unlock()
+		lock.Clean()
+	}, nil
+}
+
+// IndexRepo will wait for any other process indexing the directory, and then
+// generate the index, signed with the key if one is given.
+func IndexRepo(ctx context.Context, dir, signingKey string) error {
+	if err := checkIndexDir(dir); err != nil {
+		return err
+	}
+	unlock, err := LockRepo(ctx, dir, "indexing")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return IndexDir(ctx, dir, signingKey)
+}
+
+// An IndexedPackage is a single package listed within a repository index
+type IndexedPackage struct {
+	Name    string // Name of the package
+	Version string // Upstream version
+	Release int    // Package release number
+	Arch    string // Architecture
+	URI     string // Path of the package relative to the index
+	Size    int64  // Size of the package in bytes
+	Deltas  int    // Number of delta packages available
+}
+
+// indexListing is the subset of the index needed to list its packages
+type indexListing struct {
+	Packages []struct {
+		Name         string `xml:"Name"`
+		Architecture string `xml:"Architecture"`
+		Updates      []struct {
+			Release int    `xml:"release,attr"`
+			Version string `xml:"Version"`
+		} `xml:"History>Update"`
+		PackageURI  string       `xml:"PackageURI"`
+		PackageSize int64        `xml:"PackageSize"`
+		Deltas      []indexDelta `xml:"DeltaPackages>Delta"`
+	} `xml:"Package"`
+}
+
+// ReadIndex will return the packages listed in the index of the directory,
+// sorted by name.
+func ReadIndex(dir string) ([]*IndexedPackage, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var listing indexListing
+	if err = xml.Unmarshal(b, &listing); err != nil {
+		return nil, err
+	}
+	pkgs := make([]*IndexedPackage, 0, len(listing.Packages))
+	for _, p := range listing.Packages {
+		pkg := &IndexedPackage{
+			Name:   p.Name,
+			Arch:   p.Architecture,
+			URI:    p.PackageURI,
+			Size:   p.PackageSize,
+			Deltas: len(p.Deltas),
+		}
+		// The newest update is always first in the history
+		if len(p.Updates) > 0 {
+			pkg.Version = p.Updates[0].Version
+			pkg.Release = p.Updates[0].Release
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Arch < pkgs[j].Arch
+	})
+	return pkgs, nil
+}
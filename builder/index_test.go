@@ -0,0 +1,226 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"github.com/ulikunitz/xz"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testMetadata = `<?xml version="1.0" ?>
+<PISI>
+    <Source>
+        <Name>nano</Name>
+        <Homepage>https://www.nano-editor.org</Homepage>
+        <Packager>
+            <Name>Solus Team</Name>
+            <Email>root@getsol.us</Email>
+        </Packager>
+    </Source>
+    <Package>
+        <Name>nano</Name>
+        <Summary xml:lang="en">Small editor</Summary>
+        <PartOf>system.utils</PartOf>
+        <History>
+            <Update release="%d">
+                <Date>2021-01-01</Date>
+                <Version>5.4</Version>
+            </Update>
+        </History>
+        <Architecture>x86_64</Architecture>
+    </Package>
+</PISI>
+`
+
+func writeTestEopkg(t *testing.T, dir string, release int) {
+	path := filepath.Join(dir, fmt.Sprintf("nano-5.4-%d-1-x86_64.eopkg", release))
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create eopkg: %v", err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, err := zw.Create(MetadataFile)
+	if err != nil {
+		t.Fatalf("Failed to create metadata: %v", err)
+	}
+	fmt.Fprintf(w, testMetadata, release)
+	if err = zw.Close(); err != nil {
+		t.Fatalf("Failed to write eopkg: %v", err)
+	}
+}
+
+func TestIndexDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-index")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestEopkg(t, dir, 119)
+	writeTestEopkg(t, dir, 120)
+
+	if err = IndexDir(context.Background(), dir, ""); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	index := string(b)
+	if strings.Count(index, "<Package>") != 1 || !strings.Contains(index, `<Update release="120">`) {
+		t.Fatalf("Only the newest release should be indexed:\n%s", index)
+	}
+	for _, want := range []string{
+		"<PackageURI>nano-5.4-120-1-x86_64.eopkg</PackageURI>",
+		"<PackageHash>",
+		"<Homepage>https://www.nano-editor.org</Homepage>",
+	} {
+		if !strings.Contains(index, want) {
+			t.Fatalf("Index is missing %s:\n%s", want, index)
+		}
+	}
+
+	sum, err := ioutil.ReadFile(filepath.Join(dir, IndexFile+IndexSha1Suffix))
+	if err != nil {
+		t.Fatalf("Failed to read index sha1sum: %v", err)
+	}
+	if hash, _ := FileSha1sum(filepath.Join(dir, IndexFile)); string(sum) != hash {
+		t.Fatalf("Invalid index sha1sum: %s != %s", sum, hash)
+	}
+
+	f, err := os.Open(filepath.Join(dir, IndexXZFile))
+	if err != nil {
+		t.Fatalf("Failed to open compressed index: %v", err)
+	}
+	defer f.Close()
+	r, err := xz.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to read compressed index: %v", err)
+	}
+	if xb, err := ioutil.ReadAll(r); err != nil || string(xb) != index {
+		t.Fatalf("Compressed index doesn't match: %v", err)
+	}
+
+	pkgs, err := ReadIndex(dir)
+	if err != nil {
+		t.Fatalf("Failed to list index: %v", err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Name != "nano" || pkgs[0].Version != "5.4" || pkgs[0].Release != 120 || pkgs[0].Arch != "x86_64" {
+		t.Fatalf("Invalid index listing: %+v", pkgs)
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-index")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestEopkg(t, dir, 119)
+	writeTestEopkg(t, dir, 120)
+	if err = IndexDir(context.Background(), dir, ""); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+	if cache := LoadIndexCache(dir); len(cache.Entries) != 2 {
+		t.Fatalf("Expected 2 cached packages, got %d", len(cache.Entries))
+	}
+
+	// Unchanged size and mtime means the package isn't read again
+	path := filepath.Join(dir, "nano-5.4-120-1-x86_64.eopkg")
+	st, _ := os.Stat(path)
+	if err = ioutil.WriteFile(path, make([]byte, st.Size()), 00644); err != nil {
+		t.Fatalf("Failed to replace eopkg: %v", err)
+	}
+	os.Chtimes(path, st.ModTime(), st.ModTime())
+	if err = IndexDir(context.Background(), dir, ""); err != nil {
+		t.Fatalf("Failed to index from the cache: %v", err)
+	}
+
+	// Removed packages drop out of the cache and index
+	os.Remove(path)
+	if err = IndexDir(context.Background(), dir, ""); err != nil {
+		t.Fatalf("Failed to reindex: %v", err)
+	}
+	if cache := LoadIndexCache(dir); len(cache.Entries) != 1 {
+		t.Fatalf("Expected 1 cached package, got %d", len(cache.Entries))
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if !strings.Contains(string(b), `<Update release="119">`) {
+		t.Fatalf("Index should fall back to the older release:\n%s", b)
+	}
+}
+
+func TestIndexUnsigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-index")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestEopkg(t, dir, 120)
+
+	// A signature from an earlier run no longer matches the index
+	stale := filepath.Join(dir, IndexXZFile+IndexSignatureSuffix)
+	if err = ioutil.WriteFile(stale, []byte("stale"), 00644); err != nil {
+		t.Fatalf("Failed to write signature: %v", err)
+	}
+	if err = IndexDir(context.Background(), dir, ""); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+	if PathExists(stale) {
+		t.Fatal("Stale signature should have been removed")
+	}
+	if err = VerifyIndex(dir, "keyring.gpg"); err != ErrIndexNotSigned {
+		t.Fatalf("Expected ErrIndexNotSigned, got %v", err)
+	}
+}
+
+func TestIndexMissingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-index")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "typo", "path")
+
+	m := &Manager{lock: new(sync.Mutex)}
+	if err = m.Index(context.Background(), missing); err != ErrCannotContinue {
+		t.Fatalf("Indexing a missing directory should fail, got: %v", err)
+	}
+	if err = IndexRepo(context.Background(), missing, ""); err != ErrCannotContinue {
+		t.Fatalf("Indexing a missing repo should fail, got: %v", err)
+	}
+	if PathExists(filepath.Join(dir, "typo")) {
+		t.Fatal("Indexing a missing directory should not create it")
+	}
+
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, nil, 00644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err = m.Index(context.Background(), file); err != ErrCannotContinue {
+		t.Fatalf("Indexing a file should fail, got: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// IndexCacheName is the name of the file within a repository that caches
+	// the metadata of each package between index runs.
+	IndexCacheName = ".solbuild-index.cache"
+
+	// indexCacheVersion is bumped whenever the format of the cache changes
+	indexCacheVersion = 1
+)
+
+// indexCacheEntry is the cached information for a single package file. It is
+// only valid while the size and mtime of the file remain the same.
+type indexCacheEntry struct {
+	Size         int64  `json:"size"`
+	ModTime      int64  `json:"mtime"`
+	Hash         string `json:"sha1"`
+	MetadataHash string `json:"metadata_sha256,omitempty"`
+	Metadata     []byte `json:"metadata,omitempty"`
+}
+
+// An IndexCache allows indexing to skip reading packages that haven't changed
+// since the last run. Only the entries used during a run are saved, so that
+// removed packages drop out of the cache.
+type IndexCache struct {
+	Version int                         `json:"version"`
+	Entries map[string]*indexCacheEntry `json:"entries"`
+
+	path string                      // Where the cache is stored
+	used map[string]*indexCacheEntry // Entries seen during this run
+	hits int                         // Number of files found in the cache
+}
+
+// metadataHash will return the sha256sum of the raw metadata
+func metadataHash(metadata []byte) string {
+	h := sha256.Sum256(metadata)
+	return hex.EncodeToString(h[:])
+}
+
+// LoadIndexCache will load the index cache for the repository directory. A
+// missing or invalid cache is not an error, the packages will be read again.
+func LoadIndexCache(dir string) *IndexCache {
+	c := &IndexCache{
+		Version: indexCacheVersion,
+		Entries: make(map[string]*indexCacheEntry),
+		path:    filepath.Join(dir, IndexCacheName),
+		used:    make(map[string]*indexCacheEntry),
+	}
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return c
+	}
+	var stored IndexCache
+	if err = json.Unmarshal(b, &stored); err != nil || stored.Version != indexCacheVersion {
+		log.WithFields(log.Fields{
+			"path":  c.path,
+			"error": err,
+		}).Debug("Ignoring invalid index cache")
+		return c
+	}
+	if stored.Entries != nil {
+		c.Entries = stored.Entries
+	}
+	return c
+}
+
+// lookup will return the cached entry for the file, if it is still valid
+func (c *IndexCache) lookup(uri string, info os.FileInfo) *indexCacheEntry {
+	e, ok := c.Entries[uri]
+	if !ok || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() {
+		return nil
+	}
+	if e.MetadataHash != "" && metadataHash(e.Metadata) != e.MetadataHash {
+		return nil
+	}
+	c.hits++
+	return e
+}
+
+// keep will record the entry as in use, so that it is saved
+func (c *IndexCache) keep(uri string, e *indexCacheEntry) {
+	c.used[uri] = e
+}
+
+// newIndexCacheEntry will create a cache entry for the file, with optional
+// metadata for packages.
+func newIndexCacheEntry(info os.FileInfo, hash string, metadata []byte) *indexCacheEntry {
+	e := &indexCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hash,
+	}
+	if metadata != nil {
+		e.Metadata = metadata
+		e.MetadataHash = metadataHash(metadata)
+	}
+	return e
+}
+
+// fileHash will return the sha1sum of the file, from the cache if possible
+func (c *IndexCache) fileHash(path, uri string, info os.FileInfo) (string, error) {
+	if e := c.lookup(uri, info); e != nil {
+		c.keep(uri, e)
+		return e.Hash, nil
+	}
+	hash, err := FileSha1sum(path)
+	if err != nil {
+		return "", err
+	}
+	c.keep(uri, newIndexCacheEntry(info, hash, nil))
+	return hash, nil
+}
+
+// Save will atomically write out the entries used during this run
+func (c *IndexCache) Save() error {
+	c.Entries = c.used
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".part"
+	if err = ioutil.WriteFile(tmp, b, 00644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/getsolus/libosdev/disk"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EopkgSuffix is the extension of every binary package
+	EopkgSuffix = ".eopkg"
+
+	// DeltaSuffix is the extension of delta packages
+	DeltaSuffix = ".delta.eopkg"
+)
+
+var (
+	// ErrNoLocalRepo is returned when publishing with a profile that has no
+	// local repos
+	ErrNoLocalRepo = errors.New("The profile has no local repositories")
+
+	// ErrAmbiguousLocalRepo is returned when publishing without naming a repo,
+	// and the profile has more than one local repo
+	ErrAmbiguousLocalRepo = errors.New("The profile has multiple local repositories, one must be named")
+
+	// ErrInvalidEopkgName is returned when a file isn't named as an eopkg
+	ErrInvalidEopkgName = errors.New("Not a valid eopkg file name")
+
+	// eopkgNameRegex splits name-version-release-build-arch.eopkg, where the
+	// name itself may contain dashes.
+	eopkgNameRegex = regexp.MustCompile(`^(.+)-([^-]+)-([0-9]+)-([0-9]+)-([^-]+)\.eopkg$`)
+)
+
+// An EopkgFile is the identity of a package as encoded in its file name
+type EopkgFile struct {
+	Path    string // Full path to the file
+	Name    string // Name of the package
+	Version string // Upstream version
+	Release int    // Package release number
+	Build   int    // Distribution build number
+	Arch    string // Architecture
+}
+
+// ParseEopkgFilename will determine the identity of the package from its
+// file name, i.e. nano-5.4-120-1-x86_64.eopkg
+func ParseEopkgFilename(path string) (*EopkgFile, error) {
+	base := filepath.Base(path)
+	if strings.HasSuffix(base, DeltaSuffix) {
+		return nil, ErrInvalidEopkgName
+	}
+	match := eopkgNameRegex.FindStringSubmatch(base)
+	if match == nil {
+		return nil, ErrInvalidEopkgName
+	}
+	release, err := strconv.Atoi(match[3])
+	if err != nil {
+		return nil, ErrInvalidEopkgName
+	}
+	build, err := strconv.Atoi(match[4])
+	if err != nil {
+		return nil, ErrInvalidEopkgName
+	}
+	return &EopkgFile{
+		Path:    path,
+		Name:    match[1],
+		Version: match[2],
+		Release: release,
+		Build:   build,
+		Arch:    match[5],
+	}, nil
+}
+
+// LocalRepo will return the named local repo from the profile. If no name is
+// given, the profile must have exactly one local repo.
+func (p *Profile) LocalRepo(name string) (*Repo, error) {
+	if name != "" {
+		repo, ok := p.Repos[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown repository '%s' in profile %s", name, p.Name)
+		}
+		if !repo.Local {
+			return nil, fmt.Errorf("Repository '%s' in profile %s is not local", name, p.Name)
+		}
+		return repo, nil
+	}
+
+	var found *Repo
+	for _, repo := range p.Repos {
+		if !repo.Local {
+			continue
+		}
+		if found != nil {
+			return nil, ErrAmbiguousLocalRepo
+		}
+		found = repo
+	}
+	if found == nil {
+		return nil, ErrNoLocalRepo
+	}
+	return found, nil
+}
+
+// PruneRepo will remove all but the newest retention releases of each named
+// package from the repo directory, along with any deltas from or to them,
+// returning the paths removed. If no names are given every package is pruned.
+// A retention of 0 keeps everything.
+func PruneRepo(dir string, names []string, retention int) ([]string, error) {
+	if retention < 1 {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+EopkgSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	// Group each release by package name and architecture
+	groups := make(map[string][]*EopkgFile)
+	for _, path := range paths {
+		f, err := ParseEopkgFilename(path)
+		if err != nil || (len(wanted) > 0 && !wanted[f.Name]) {
+			continue
+		}
+		key := f.Name + "/" + f.Arch
+		groups[key] = append(groups[key], f)
+	}
+
+	var removed []string
+	dropped := make(map[string]map[int]bool)
+	for key, files := range groups {
+		if len(files) <= retention {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			if files[i].Release != files[j].Release {
+				return files[i].Release > files[j].Release
+			}
+			return files[i].Build > files[j].Build
+		})
+		kept := make(map[int]bool)
+		for _, f := range files[:retention] {
+			kept[f.Release] = true
+		}
+		for _, f := range files[retention:] {
+			log.WithFields(log.Fields{
+				"file": filepath.Base(f.Path),
+			}).Debug("Removing old release from repository")
+			if err := os.Remove(f.Path); err != nil {
+				return removed, err
+			}
+			removed = append(removed, f.Path)
+			if !kept[f.Release] {
+				if dropped[key] == nil {
+					dropped[key] = make(map[int]bool)
+				}
+				dropped[key][f.Release] = true
+			}
+		}
+	}
+
+	// Deltas from or to a removed release are no use to anyone
+	deltas, err := filepath.Glob(filepath.Join(dir, "*"+DeltaSuffix))
+	if err != nil {
+		return removed, err
+	}
+	for _, path := range deltas {
+		match := deltaNameRegex.FindStringSubmatch(filepath.Base(path))
+		if match == nil {
+			continue
+		}
+		releases := dropped[match[1]+"/"+match[5]]
+		from, _ := strconv.Atoi(match[2])
+		to, _ := strconv.Atoi(match[3])
+		if !releases[from] && !releases[to] {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"file": filepath.Base(path),
+		}).Debug("Removing stale delta from repository")
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// AddToRepo will copy the packages into the local repo, returning the paths
+// they were added as. Files that aren't packages, such as manifests, are
+// skipped.
+func AddToRepo(repo *Repo, files []string) ([]string, error) {
+	if err := os.MkdirAll(repo.URI, 00755); err != nil {
+		return nil, err
+	}
+
+	var added []string
+	for _, file := range files {
+		if _, err := ParseEopkgFilename(file); err != nil {
+			continue
+		}
+		tgt := filepath.Join(repo.URI, filepath.Base(file))
+		log.WithFields(log.Fields{
+			"file": filepath.Base(file),
+			"repo": repo.Name,
+		}).Debug("Adding package to repository")
+
+		// Don't let anything see a partial package
+		tmp := tgt + ".part"
+		if err := disk.CopyFile(file, tmp); err != nil {
+			os.Remove(tmp)
+			return added, err
+		}
+		if err := os.Rename(tmp, tgt); err != nil {
+			os.Remove(tmp)
+			return added, err
+		}
+		added = append(added, tgt)
+	}
+	return added, nil
+}
+
+// RemoveFromRepo will remove every release of the named packages from the
+// repo directory, along with their deltas, returning the paths removed.
+func RemoveFromRepo(dir string, names []string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+EopkgSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var removed []string
+	for _, path := range paths {
+		var name string
+		if f, err := ParseEopkgFilename(path); err == nil {
+			name = f.Name
+		} else if match := deltaNameRegex.FindStringSubmatch(filepath.Base(path)); match != nil {
+			name = match[1]
+		}
+		if !wanted[name] {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"file": filepath.Base(path),
+		}).Debug("Removing package from repository")
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// Publish will copy the built packages into the local repo, remove any older
+// releases beyond the retention count and then reindex the repo, so that the
+// next build will see them. The repo is locked throughout, so nobody else can
+// index it half way through.
+func (p *Package) Publish(ctx context.Context, repo *Repo, files []string, retention int) (*PublishData, error) {
+	data := &PublishData{Repo: repo.Name}
+	unlock, err := LockRepo(ctx, repo.URI, "publishing")
+	if err != nil {
+		return data, err
+	}
+	defer unlock()
+
+	published, err := AddToRepo(repo, files)
+	data.Published = published
+	if err != nil {
+		return data, err
+	}
+	if len(published) == 0 {
+		return data, errors.New("No packages to publish")
+	}
+
+	var names []string
+	for _, path := range published {
+		if f, err := ParseEopkgFilename(path); err == nil {
+			names = append(names, f.Name)
+		}
+	}
+
+	removed, err := PruneRepo(repo.URI, names, retention)
+	data.Removed = removed
+	if err != nil {
+		return data, err
+	}
+
+	return data, IndexDir(ctx, repo.URI, repo.SigningKey)
+}
@@ -0,0 +1,125 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseEopkgFilename(t *testing.T) {
+	f, err := ParseEopkgFilename("/var/lib/solbuild/local/font-util-devel-1.3.2-12-1-x86_64.eopkg")
+	if err != nil {
+		t.Fatalf("Failed to parse eopkg name: %v", err)
+	}
+	if f.Name != "font-util-devel" || f.Version != "1.3.2" || f.Release != 12 || f.Build != 1 || f.Arch != "x86_64" {
+		t.Fatalf("Invalid eopkg identity: %+v", f)
+	}
+	for _, name := range []string{"nano-119-120-1-x86_64.delta.eopkg", "nano.eopkg", "pspec_x86_64.xml"} {
+		if _, err := ParseEopkgFilename(name); err != ErrInvalidEopkgName {
+			t.Fatalf("Should not parse %s as an eopkg", name)
+		}
+	}
+}
+
+func TestPruneRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-repo")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"nano-5.3-118-1-x86_64.eopkg",
+		"nano-5.4-119-1-x86_64.eopkg",
+		"nano-5.4-120-1-x86_64.eopkg",
+		"nano-dbginfo-5.4-120-1-x86_64.eopkg",
+		"vim-8.2-300-1-x86_64.eopkg",
+		"vim-8.2-301-1-x86_64.eopkg",
+		"nano-118-120-1-x86_64.delta.eopkg",
+		"nano-119-120-1-x86_64.delta.eopkg",
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 00644); err != nil {
+			t.Fatalf("Failed to write %s: %v", f, err)
+		}
+	}
+
+	removed, err := PruneRepo(dir, []string{"nano", "nano-dbginfo"}, 2)
+	if err != nil {
+		t.Fatalf("Failed to prune repo: %v", err)
+	}
+	if len(removed) != 2 || filepath.Base(removed[0]) != files[6] || filepath.Base(removed[1]) != files[0] {
+		t.Fatalf("Only the oldest nano and its delta should be removed, got: %v", removed)
+	}
+	if remaining, _ := filepath.Glob(filepath.Join(dir, "*.eopkg")); len(remaining) != 6 {
+		t.Fatalf("Other packages should be untouched, got: %v", remaining)
+	}
+}
+
+func TestRemoveFromRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-repo")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"nano-5.4-119-1-x86_64.eopkg",
+		"nano-5.4-120-1-x86_64.eopkg",
+		"nano-119-120-1-x86_64.delta.eopkg",
+		"nano-dbginfo-5.4-120-1-x86_64.eopkg",
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 00644); err != nil {
+			t.Fatalf("Failed to write %s: %v", f, err)
+		}
+	}
+
+	removed, err := RemoveFromRepo(dir, []string{"nano"})
+	if err != nil {
+		t.Fatalf("Failed to remove from repo: %v", err)
+	}
+	if len(removed) != 3 {
+		t.Fatalf("Every nano release and delta should be removed, got: %v", removed)
+	}
+	if !PathExists(filepath.Join(dir, files[3])) {
+		t.Fatalf("Other packages should be untouched")
+	}
+}
+
+func TestProfileLocalRepo(t *testing.T) {
+	profile := &Profile{
+		Name: "local",
+		Repos: map[string]*Repo{
+			"Solus": {Name: "Solus", URI: "https://example.com/eopkg-index.xml.xz"},
+			"Local": {Name: "Local", URI: "/var/lib/solbuild/local", Local: true},
+		},
+	}
+	if repo, err := profile.LocalRepo(""); err != nil || repo.Name != "Local" {
+		t.Fatalf("Should find the only local repo, got: %v", err)
+	}
+	if _, err := profile.LocalRepo("Solus"); err == nil {
+		t.Fatalf("Should not publish to a remote repo")
+	}
+	profile.Repos["Other"] = &Repo{Name: "Other", URI: "/srv/other", Local: true}
+	if _, err := profile.LocalRepo(""); err != ErrAmbiguousLocalRepo {
+		t.Fatalf("Should require a name with multiple local repos, got: %v", err)
+	}
+}
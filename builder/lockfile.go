@@ -17,12 +17,20 @@
 package builder
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
@@ -32,8 +40,32 @@ var (
 	// ErrOwnedLockFile is returned when the lockfile is already owned by
 	// another active process.
 	ErrOwnedLockFile = errors.New("File is locked")
+
+	// ErrLockTimeout is returned when we gave up waiting for another process
+	// to release the lockfile.
+	ErrLockTimeout = errors.New("Timed out waiting for lockfile")
+)
+
+const (
+	// LockPollInterval is how often we retry a lockfile held by another process
+	LockPollInterval = 500 * time.Millisecond
+
+	// LockProgressInterval is how often we report that we're still waiting
+	// on a lockfile held by another process
+	LockProgressInterval = 10 * time.Second
 )
 
+// LockInfo is the metadata stored within a lockfile, describing the process
+// that owns it and what it is doing.
+type LockInfo struct {
+	PID       int       `toml:"pid"`       // Process ID of the owner
+	Operation string    `toml:"operation"` // i.e. building, chroot, updating
+	Package   string    `toml:"package"`   // Package being operated on, if any
+	Profile   string    `toml:"profile"`   // Profile in use
+	Started   time.Time `toml:"started"`   // When the lock was taken
+	User      string    `toml:"user"`      // The user that invoked solbuild
+}
+
 // A LockFile encapsulates locking functionality
 type LockFile struct {
 	path      string        // Path of the lockfile
@@ -42,6 +74,9 @@ type LockFile struct {
 	conlock   *sync.RWMutex // Concurrency lock for library use
 	fd        *os.File      // Actual file being locked
 	owner     bool          // Whether we're the owner..
+	shared    bool          // Whether to take a shared lock instead
+	info      *LockInfo     // Metadata to store once we own the lock
+	ownerInfo *LockInfo     // Metadata of the lockfile owner, if known
 }
 
 // NewLockFile will return a new lockfile for the given path
@@ -74,6 +109,24 @@ func NewLockFile(path string) (*LockFile, error) {
 	return lock, nil
 }
 
+// SetInfo will set the metadata that we store in the lockfile once we own it.
+// The PID is always set to our own.
+func (l *LockFile) SetInfo(info *LockInfo) {
+	l.info = info
+}
+
+// SetShared will make the lockfile take a shared lock, which many processes
+// may hold at once, but never alongside an exclusive lock. A shared lock
+// doesn't store our metadata, and leaves the lockfile in place when cleaned.
+func (l *LockFile) SetShared(shared bool) {
+	l.shared = shared
+}
+
+// GetOwnerInfo will return the metadata of the lockfile owner, if known
+func (l *LockFile) GetOwnerInfo() *LockInfo {
+	return l.ownerInfo
+}
+
 // GetOwnerPID will return the owner PID, if it exists
 func (l *LockFile) GetOwnerPID() int {
 	return l.owningPID
@@ -91,12 +144,19 @@ func (l *LockFile) GetOwnerProcess() string {
 
 // Lock will attempt to lock the file, or return an error if this fails
 func (l *LockFile) Lock() error {
-	pid, err := l.readPID()
+	if l.shared {
+		return l.lockShared()
+	}
+	info, err := l.readInfo()
 
 	// Bail now.
 	if err != ErrDeadLockFile && err != ErrOwnedLockFile && err != nil {
 		return err
 	}
+	pid := -1
+	if info != nil {
+		pid = info.PID
+	}
 
 	// Not gonna test our *own* PID
 	if pid > 0 && pid != l.ourPID {
@@ -106,6 +166,7 @@ func (l *LockFile) Lock() error {
 		if err2 := p.Signal(syscall.Signal(0)); err2 == nil {
 			if p.Pid != l.ourPID {
 				l.owningPID = p.Pid
+				l.ownerInfo = info
 				return ErrOwnedLockFile
 			}
 		}
@@ -123,8 +184,111 @@ func (l *LockFile) Lock() error {
 
 	l.conlock.Unlock()
 
-	// Write the PID now we have an exclusive lock on it
-	return l.writePID()
+	// Write our details now we have an exclusive lock on it
+	return l.writeInfo()
+}
+
+// lockShared will attempt to take a shared lock on the file. Only the holder
+// of an exclusive lock can stop us, so its metadata is the owner's.
+func (l *LockFile) lockShared() error {
+	l.conlock.Lock()
+	err := syscall.Flock(int(l.fd.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		l.owner = true
+	}
+	l.conlock.Unlock()
+
+	if err != syscall.EWOULDBLOCK {
+		return err
+	}
+	if info, err := l.readInfo(); err == nil {
+		l.owningPID = info.PID
+		l.ownerInfo = info
+	}
+	return ErrOwnedLockFile
+}
+
+// LockWait will attempt to lock the file, waiting for any other process that
+// currently holds it to let go first. A timeout of 0 will wait forever, or
+// until the context is cancelled.
+//
+// The waiting function, if set, is called periodically whilst the lock is
+// still held elsewhere, allowing the caller to report progress.
+func (l *LockFile) LockWait(ctx context.Context, timeout time.Duration, waiting func()) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	var lastReport time.Time
+
+	for {
+		err := l.Lock()
+		if err == nil {
+			// The previous owner may have removed the file after we opened
+			// it, in which case we've only locked an orphaned inode.
+			if l.isCurrent() {
+				return nil
+			}
+			l.Unlock()
+			l.owner = false
+		} else if err != ErrOwnedLockFile && err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		if waiting != nil && time.Since(lastReport) >= LockProgressInterval {
+			waiting()
+			lastReport = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(LockPollInterval):
+		}
+
+		if err := l.reopen(); err != nil {
+			return err
+		}
+	}
+}
+
+// isCurrent will determine whether our file descriptor still refers to the
+// lockfile on disk, i.e. it hasn't been cleaned up by another process.
+func (l *LockFile) isCurrent() bool {
+	if l.fd == nil {
+		return false
+	}
+	ours, err := l.fd.Stat()
+	if err != nil {
+		return false
+	}
+	theirs, err := os.Stat(l.path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ours, theirs)
+}
+
+// reopen will open the lockfile again if it was replaced or removed since we
+// last opened it, so that we're always contending on the live file.
+func (l *LockFile) reopen() error {
+	if l.isCurrent() {
+		return nil
+	}
+	l.conlock.Lock()
+	defer l.conlock.Unlock()
+
+	w, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 00644)
+	if err != nil {
+		return err
+	}
+	if l.fd != nil {
+		l.fd.Close()
+	}
+	l.fd = w
+	return nil
 }
 
 // Unlock will attempt to unlock the file, or return an error if this fails
@@ -136,39 +300,57 @@ func (l *LockFile) Unlock() error {
 	return syscall.Flock(int(l.fd.Fd()), syscall.LOCK_UN)
 }
 
-// readPID is a simple utility to extract the PID from a file
-func (l *LockFile) readPID() (int, error) {
+// readInfo is a simple utility to extract the metadata from a file
+func (l *LockFile) readInfo() (*LockInfo, error) {
 	l.conlock.RLock()
 	defer l.conlock.RUnlock()
+	return ReadLockInfo(l.path)
+}
 
-	fi, err := os.Open(l.path)
+// ReadLockInfo will read the metadata from the lockfile at the given path.
+// Older lockfiles containing only a bare PID are also supported.
+func ReadLockInfo(path string) (*LockInfo, error) {
+	b, err := ioutil.ReadFile(path)
 	// Likely a permission issue.
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	defer fi.Close()
-	var pid int
-	var n int
 
-	// This is ok, we can just nuke it..
-	if n, err = fmt.Fscanf(fi, "%d", &pid); err != nil {
-		return -1, ErrDeadLockFile
+	info := &LockInfo{}
+	if _, err = toml.Decode(string(b), info); err == nil && info.PID > 0 {
+		return info, nil
 	}
-	// This is actually ok.
-	if n != 1 {
-		return -1, ErrDeadLockFile
+
+	// This is ok, we can just nuke it..
+	var pid int
+	if n, err := fmt.Sscanf(string(b), "%d", &pid); err != nil || n != 1 {
+		return nil, ErrDeadLockFile
 	}
-	return pid, nil
+	return &LockInfo{PID: pid}, nil
 }
 
-// writePID will store our PID in the lockfile
-func (l *LockFile) writePID() error {
+// writeInfo will store our metadata in the lockfile
+func (l *LockFile) writeInfo() error {
 	if l.fd == nil {
 		panic(errors.New("cannot write PID for no file"))
 	}
+	info := LockInfo{}
+	if l.info != nil {
+		info = *l.info
+	}
+	info.PID = l.ourPID
+
+	blob := bytes.Buffer{}
+	if err := toml.NewEncoder(&blob).Encode(&info); err != nil {
+		return err
+	}
+
 	l.conlock.Lock()
 	defer l.conlock.Unlock()
-	if _, err := fmt.Fprintf(l.fd, "%d", l.ourPID); err != nil {
+	if err := l.fd.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.fd.WriteAt(blob.Bytes(), 0); err != nil {
 		return err
 	}
 	return l.fd.Sync()
@@ -183,8 +365,119 @@ func (l *LockFile) Clean() error {
 	}
 
 	l.fd.Close()
-	if l.owner {
+	// Other processes may still hold their own shared lock
+	if l.owner && !l.shared {
 		return os.Remove(l.path)
 	}
 	return nil
 }
+
+// A LockStatus describes a lockfile found on disk
+type LockStatus struct {
+	Path   string    // Path to the lockfile
+	Info   *LockInfo // Metadata stored in the lockfile, if readable
+	Active bool      // Whether the lock is currently held by a process
+}
+
+// NewLockStatus will inspect the lockfile at the given path, determining if
+// it is still held by a live process or has been left behind.
+func NewLockStatus(path string) (*LockStatus, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	status := &LockStatus{Path: path}
+	if info, err := ReadLockInfo(path); err == nil {
+		status.Info = info
+	}
+
+	// An exclusive lock can only be taken if nobody holds it at all, shared
+	// holders included
+	err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		status.Active = true
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+	return status, nil
+}
+
+// Clear will remove a stale lockfile from disk. An active lockfile will
+// never be removed, and ErrOwnedLockFile is returned instead.
+func (s *LockStatus) Clear() error {
+	fd, err := os.OpenFile(s.Path, os.O_RDWR, 00644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	// Hold the lock ourselves whilst removing, so nobody can sneak in
+	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			s.Active = true
+			return ErrOwnedLockFile
+		}
+		return err
+	}
+	defer syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+
+	// Make sure it wasn't replaced since we inspected it
+	ours, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	theirs, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(ours, theirs) {
+		return ErrOwnedLockFile
+	}
+	return os.Remove(s.Path)
+}
+
+// GetAllLocks will find every lockfile used by solbuild, for both the build
+// overlays and the backing images.
+func GetAllLocks(config *Config) ([]*LockStatus, error) {
+	patterns := []string{
+		filepath.Join(config.OverlayRootDir, "*", "*.lock"),
+		filepath.Join(ImagesDir, "*.lock"),
+	}
+	var paths []string
+	for _, pat := range patterns {
+		found, _ := filepath.Glob(pat)
+		paths = append(paths, found...)
+	}
+	sort.Strings(paths)
+
+	var ret []*LockStatus
+	for _, p := range paths {
+		status, err := NewLockStatus(p)
+		if err != nil {
+			// Cleaned up whilst we were looking at it
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		ret = append(ret, status)
+	}
+	return ret, nil
+}
+
+// lockUser will determine the name of the user that invoked solbuild, taking
+// sudo into account.
+func lockUser() string {
+	if name := strings.TrimSpace(os.Getenv("SUDO_USER")); name != "" {
+		return name
+	}
+	if usr, err := user.Current(); err == nil {
+		return usr.Username
+	}
+	return fmt.Sprintf("%d", os.Getuid())
+}
@@ -0,0 +1,199 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-lock")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lock")
+
+	owner, err := NewLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create lockfile: %v", err)
+	}
+	if err = owner.Lock(); err != nil {
+		t.Fatalf("Failed to lock fresh lockfile: %v", err)
+	}
+
+	waiter, err := NewLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create second lockfile: %v", err)
+	}
+	if err = waiter.LockWait(context.Background(), time.Second, nil); err != ErrLockTimeout {
+		t.Fatalf("Should have timed out on held lockfile, got: %v", err)
+	}
+
+	// Release the lock whilst the waiter is still waiting
+	go func() {
+		time.Sleep(LockPollInterval)
+		owner.Unlock()
+		owner.Clean()
+	}()
+	if err = waiter.LockWait(context.Background(), 0, nil); err != nil {
+		t.Fatalf("Failed to acquire released lockfile: %v", err)
+	}
+	if !waiter.isCurrent() {
+		t.Fatal("Acquired lock on a stale lockfile")
+	}
+	if err = waiter.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	if err = waiter.Clean(); err != nil {
+		t.Fatalf("Failed to clean lockfile: %v", err)
+	}
+}
+
+func TestLockInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-lock")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lock")
+
+	lock, err := NewLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create lockfile: %v", err)
+	}
+	lock.SetInfo(&LockInfo{
+		Operation: "building",
+		Package:   "nano",
+		Profile:   "main-x86_64",
+		User:      "root",
+	})
+	if err = lock.Lock(); err != nil {
+		t.Fatalf("Failed to lock fresh lockfile: %v", err)
+	}
+
+	status, err := NewLockStatus(path)
+	if err != nil {
+		t.Fatalf("Failed to inspect lockfile: %v", err)
+	}
+	if !status.Active {
+		t.Fatal("Held lockfile should be active")
+	}
+	if status.Info == nil || status.Info.PID != os.Getpid() || status.Info.Package != "nano" {
+		t.Fatalf("Invalid lockfile metadata: %+v", status.Info)
+	}
+	if err = status.Clear(); err != ErrOwnedLockFile {
+		t.Fatalf("Should not clear an active lockfile, got: %v", err)
+	}
+
+	// Once released the lockfile is stale and may be cleared
+	if err = lock.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	if status, err = NewLockStatus(path); err != nil {
+		t.Fatalf("Failed to inspect lockfile: %v", err)
+	}
+	if status.Active {
+		t.Fatal("Released lockfile should be stale")
+	}
+	if err = status.Clear(); err != nil {
+		t.Fatalf("Failed to clear stale lockfile: %v", err)
+	}
+	if PathExists(path) {
+		t.Fatal("Stale lockfile still exists")
+	}
+
+	// Legacy lockfiles only contain the PID
+	if err = ioutil.WriteFile(path, []byte("1234"), 00644); err != nil {
+		t.Fatalf("Failed to write legacy lockfile: %v", err)
+	}
+	info, err := ReadLockInfo(path)
+	if err != nil || info.PID != 1234 {
+		t.Fatalf("Failed to read legacy lockfile: %v %+v", err, info)
+	}
+}
+
+func TestLockShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-lock")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lock")
+
+	var readers []*LockFile
+	for i := 0; i < 2; i++ {
+		reader, err := NewLockFile(path)
+		if err != nil {
+			t.Fatalf("Failed to create lockfile: %v", err)
+		}
+		reader.SetShared(true)
+		if err = reader.Lock(); err != nil {
+			t.Fatalf("Failed to take shared lock %d: %v", i, err)
+		}
+		readers = append(readers, reader)
+	}
+
+	status, err := NewLockStatus(path)
+	if err != nil {
+		t.Fatalf("Failed to inspect shared lockfile: %v", err)
+	}
+	if !status.Active {
+		t.Fatal("Shared lock should be reported as active")
+	}
+
+	writer, err := NewLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create lockfile: %v", err)
+	}
+	writer.SetInfo(&LockInfo{Operation: "updating"})
+	if err = writer.LockWait(context.Background(), time.Second, nil); err != ErrLockTimeout {
+		t.Fatalf("Should not lock exclusively whilst shared, got: %v", err)
+	}
+
+	for _, reader := range readers {
+		reader.Unlock()
+		if err = reader.Clean(); err != nil {
+			t.Fatalf("Failed to clean shared lockfile: %v", err)
+		}
+	}
+	if !PathExists(path) {
+		t.Fatal("Shared lock should not remove the lockfile")
+	}
+	if err = writer.LockWait(context.Background(), time.Second, nil); err != nil {
+		t.Fatalf("Failed to lock exclusively once released: %v", err)
+	}
+
+	reader, err := NewLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create lockfile: %v", err)
+	}
+	reader.SetShared(true)
+	if err = reader.Lock(); err != ErrOwnedLockFile {
+		t.Fatalf("Should not take shared lock whilst exclusive, got: %v", err)
+	}
+	if owner := reader.GetOwnerInfo(); owner == nil || owner.Operation != "updating" {
+		t.Fatalf("Invalid owner metadata: %+v", owner)
+	}
+	writer.Unlock()
+	writer.Clean()
+}
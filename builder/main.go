@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 // DisableColors controls whether or not to use colours in the display.
@@ -125,7 +126,12 @@ func EmitProfileError(p string) {
 		return
 	}
 
+	var names []string
 	for key := range profiles {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	for _, key := range names {
 		fmt.Fprintf(os.Stderr, " * %v\n", key)
 	}
 }
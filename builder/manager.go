@@ -17,11 +17,14 @@
 package builder
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -51,6 +54,9 @@ var (
 
 	// ErrInterrupted is returned when the build is interrupted
 	ErrInterrupted = errors.New("The operation was cancelled by the user")
+
+	// ErrTimedOut is returned when the build exceeded its time limit
+	ErrTimedOut = errors.New("The build exceeded its time limit")
 )
 
 // A Manager is responsible for cleanly managing the entire session within solbuild,
@@ -78,9 +84,40 @@ type Manager struct {
 
 	manifestTarget string // Generate manifest if set
 
-	activePID int // Active PID
+	activePID int       // Active PID
+	cgroup    *Cgroup   // Cgroup containing the build, if any
+	stdout    io.Writer // Where command output is written to
+	stderr    io.Writer // Where command errors are written to
+
+	buildLog  *BuildLog // Persistent log of the current operation, if any
+	logStdout io.Writer // Log writer for command output
+	logStderr io.Writer // Log writer for command errors
+
+	observers []Observer   // Observers of build events
+	report    *BuildReport // Report of the current build, if any
+	artifacts []string     // Files collected from the current build
+
+	publish     bool   // Whether to publish the built packages
+	publishRepo string // Local repo to publish to, empty for the only one
+	signingKey  string // Key to sign the index with, overriding the profile
+
+	skipDepsCheck bool // Whether to skip resolving build dependencies up front
+
+	lockWait    bool          // Whether to wait for locks held by other processes
+	lockTimeout time.Duration // How long to wait for a held lock, 0 is forever
+
+	buildTimeout  time.Duration // Time limit for builds, 0 is unlimited
+	configTimeout time.Duration // Time limit for builds set in the config
+	defaults      Config        // Config as loaded, before any overrides
+	timedOut      bool          // Whether the build hit its time limit
 }
 
+const (
+	// BuildTimeoutGrace is how long we wait after asking the build to terminate
+	// on timeout, before tearing everything down forcibly.
+	BuildTimeoutGrace = 30 * time.Second
+)
+
 // NewManager will return a newly initialised manager instance
 func NewManager() (*Manager, error) {
 	// First things first, setup the namespace
@@ -93,11 +130,14 @@ func NewManager() (*Manager, error) {
 		updateMode: false,
 		lockfile:   nil,
 		didStart:   false,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
 	}
 
 	// Now load the configuration in
 	if config, err := NewConfig(); err == nil {
 		man.Config = config
+		man.defaults = *config
 	} else {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -105,10 +145,186 @@ func NewManager() (*Manager, error) {
 		return nil, err
 	}
 
+	if timeout := strings.TrimSpace(man.Config.BuildTimeout); timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"timeout": timeout,
+			}).Error("Invalid build_timeout in solbuild configuration")
+			return nil, err
+		}
+		man.configTimeout = duration
+		man.buildTimeout = duration
+	}
+
 	man.lock = new(sync.Mutex)
 	return man, nil
 }
 
+// Reset will return the manager to a clean state once an operation has been
+// completed, so that it may be used again with another profile and package.
+// The namespace and configuration are retained.
+func (m *Manager) Reset() {
+	// Should already have happened, but be sure
+	m.Cleanup()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.image = nil
+	m.overlay = nil
+	m.pkg = nil
+	m.pkgManager = nil
+	m.profile = nil
+	m.lockfile = nil
+	m.cancelled = false
+	m.updateMode = false
+	m.history = nil
+	m.manifestTarget = ""
+	m.activePID = 0
+	m.cgroup = nil
+	m.report = nil
+	m.artifacts = nil
+	m.publish = false
+	m.publishRepo = ""
+	m.signingKey = ""
+	m.skipDepsCheck = false
+	m.lockWait = false
+	m.lockTimeout = 0
+	m.buildTimeout = m.configTimeout
+	m.timedOut = false
+	*m.Config = m.defaults
+}
+
+// SetOutput will set where the output of commands run by the manager is
+// written to, i.e. to capture the output of each build. Passing nil for
+// either will restore the standard output and error streams.
+func (m *Manager) SetOutput(stdout, stderr io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	m.stdout = stdout
+	m.stderr = stderr
+}
+
+// Output will return where the output of commands should be written to
+func (m *Manager) Output() (io.Writer, io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.buildLog != nil {
+		return io.MultiWriter(m.stdout, m.logStdout), io.MultiWriter(m.stderr, m.logStderr)
+	}
+	return m.stdout, m.stderr
+}
+
+// AddObserver will register an Observer to be notified of events during
+// builds. Observers are retained across a Reset.
+func (m *Manager) AddObserver(o Observer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.observers = append(m.observers, o)
+}
+
+// Emit will send the event to all registered observers, and record it in
+// the log of the current build.
+func (m *Manager) Emit(e *Event) {
+	m.lock.Lock()
+	observers := append([]Observer(nil), m.observers...)
+	buildLog := m.buildLog
+	report := m.report
+	m.lock.Unlock()
+
+	if report != nil {
+		report.Notify(e)
+	}
+	if data, ok := e.Data.(*ArtifactsData); ok && data != nil {
+		m.lock.Lock()
+		m.artifacts = data.Files
+		m.lock.Unlock()
+	}
+
+	if buildLog != nil {
+		switch {
+		case e.Kind == EventPhaseStarted:
+			buildLog.Printf("solbuild: phase %s started", e.Phase)
+		case e.Kind == EventPhaseFinished && e.Error != nil:
+			buildLog.Printf("solbuild: phase %s failed after %s: %v", e.Phase, e.Duration, e.Error)
+		case e.Kind == EventPhaseFinished:
+			buildLog.Printf("solbuild: phase %s finished in %s", e.Phase, e.Duration)
+		}
+	}
+	for _, o := range observers {
+		o.Notify(e)
+	}
+}
+
+// startLog will begin a persistent log of the current operation, if logging
+// has been enabled in the config. Failing to do so won't stop the operation.
+func (m *Manager) startLog(opType string) {
+	if m.Config.LogDir == "" {
+		return
+	}
+	// Image updates and indexing have no package, nor does indexing need a profile
+	name, version, release := "update", "", 0
+	switch {
+	case opType == "indexing":
+		name = IndexPackage.Name
+	case m.pkg != nil:
+		name, version, release = m.pkg.Name, m.pkg.Version, m.pkg.Release
+	}
+	profile := ""
+	if m.profile != nil {
+		profile = m.profile.Name
+	}
+	buildLog, err := NewBuildLog(m.Config, profile, name, version, release)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"dir":   m.Config.LogDir,
+		}).Warning("Failed to create log file")
+		return
+	}
+
+	m.lock.Lock()
+	m.buildLog = buildLog
+	m.logStdout = buildLog.Writer()
+	m.logStderr = buildLog.Writer()
+	m.lock.Unlock()
+
+	if profile != "" {
+		buildLog.Printf("solbuild: %s %s with profile %s", opType, name, profile)
+	} else {
+		buildLog.Printf("solbuild: %s %s", opType, name)
+	}
+	log.WithFields(log.Fields{
+		"log": buildLog.Path,
+	}).Info("Logging to file")
+}
+
+// closeLog will record the result of the operation and close the log
+func (m *Manager) closeLog(err error) {
+	m.lock.Lock()
+	buildLog := m.buildLog
+	m.buildLog = nil
+	m.logStdout = nil
+	m.logStderr = nil
+	m.lock.Unlock()
+	if buildLog == nil {
+		return
+	}
+	if err != nil {
+		buildLog.Printf("solbuild: FAILED %v", err)
+	} else {
+		buildLog.Printf("solbuild: SUCCESS")
+	}
+	buildLog.Close()
+}
+
 // SetActivePID will set the active task PID
 func (m *Manager) SetActivePID(pid int) {
 	m.lock.Lock()
@@ -124,6 +340,76 @@ func (m *Manager) SetManifestTarget(target string) {
 	m.manifestTarget = strings.TrimSpace(target)
 }
 
+// SetPublish will instruct the manager to publish the built packages into the
+// named local repo of the profile once the build succeeds. If repo is empty,
+// the profile must have exactly one local repo.
+func (m *Manager) SetPublish(enable bool, repo string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.publish = enable
+	m.publishRepo = strings.TrimSpace(repo)
+}
+
+// SetSkipDepsCheck will disable resolving the build dependencies against the
+// repository indexes on the host before the build root is brought up.
+func (m *Manager) SetSkipDepsCheck(skip bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.skipDepsCheck = skip
+}
+
+// SetSigningKey will set the gpg key used to sign the index. An empty key
+// uses the signing_key of the matching local repo in the profile, if any.
+func (m *Manager) SetSigningKey(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.signingKey = strings.TrimSpace(key)
+}
+
+// indexSigningKey will return the key the directory should be signed with
+func (m *Manager) indexSigningKey(dir string) string {
+	if m.signingKey != "" || m.profile == nil {
+		return m.signingKey
+	}
+	for _, repo := range m.profile.Repos {
+		if !repo.Local {
+			continue
+		}
+		if uri, err := filepath.Abs(repo.URI); err == nil && uri == dir {
+			return repo.SigningKey
+		}
+	}
+	return ""
+}
+
+// SetOutputDir will set the directory built packages are stored in, overriding
+// the configured default. An empty dir keeps the default.
+func (m *Manager) SetOutputDir(dir string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if dir = strings.TrimSpace(dir); dir != "" {
+		m.Config.OutputDir = dir
+	}
+}
+
+// SetLockWait will instruct the manager to wait for any other process holding
+// the lock to finish, instead of failing immediately. A timeout of 0 will wait
+// indefinitely.
+func (m *Manager) SetLockWait(wait bool, timeout time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lockWait = wait
+	m.lockTimeout = timeout
+}
+
+// SetBuildTimeout will override the configured time limit for builds. A
+// timeout of 0 disables the time limit.
+func (m *Manager) SetBuildTimeout(timeout time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.buildTimeout = timeout
+}
+
 // SetProfile will attempt to initialise the manager with a given profile
 // Currently this is locked to a backing image specification, but in future
 // will be expanded to support profiles *based* on backing images.
@@ -138,10 +424,26 @@ func (m *Manager) SetProfile(profile string) error {
 	}
 
 	prof, err := NewProfile(profile)
-	if err != nil {
+	if err == ErrInvalidProfile {
 		EmitProfileError(profile)
 		return err
 	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"profile": profile,
+		}).Error("Invalid profile")
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return err
+	}
+
+	// Local repos may not have been created yet, i.e. before the first
+	// publish, so they only fail the build when they are added to the root
+	if err = prof.CheckRepos(); err != nil {
+		log.WithFields(log.Fields{
+			"profile": profile,
+			"error":   err,
+		}).Warning("Profile has missing local repos")
+	}
 
 	if !IsValidImage(prof.Image) {
 		EmitImageError(prof.Image)
@@ -226,7 +528,12 @@ func (m *Manager) Cleanup() {
 	log.Debug("Acquiring global lock")
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	// Someone else got here first
+	if !m.didStart {
+		return
+	}
 	log.Debug("Cleaning up")
+	defer func() { m.didStart = false }()
 
 	if m.pkgManager != nil {
 		// Potentially unnecessary but meh
@@ -251,6 +558,12 @@ func (m *Manager) Cleanup() {
 		m.activePID = 0
 	}
 
+	// Everything in the build cgroup can go in one shot
+	if m.cgroup != nil {
+		m.cgroup.Report()
+		m.cgroup.Kill()
+	}
+
 	// Still might have *something* alive in there, kill it with fire.
 	if deathPoint != "" {
 		for i := 0; i < 10; i++ {
@@ -270,6 +583,16 @@ func (m *Manager) Cleanup() {
 	// Unmount anything we may have mounted
 	disk.GetMountManager().UnmountAll()
 
+	if m.cgroup != nil {
+		if err := m.cgroup.Remove(); err != nil {
+			log.WithFields(log.Fields{
+				"cgroup": m.cgroup.Path,
+				"error":  err,
+			}).Error("Failure in removing cgroup")
+		}
+		m.cgroup = nil
+	}
+
 	// Finally clean out the lock files
 	if m.lockfile != nil {
 		if err := m.lockfile.Unlock(); err != nil {
@@ -282,11 +605,23 @@ func (m *Manager) Cleanup() {
 				"error": err,
 			}).Error("Failure in cleaning lockfile")
 		}
+		m.lockfile = nil
 	}
 }
 
 // doLock will handle the relevant locking operation for the given path
-func (m *Manager) doLock(path, opType string) error {
+func (m *Manager) doLock(ctx context.Context, path, opType string) error {
+	return m.takeLock(ctx, path, opType, false)
+}
+
+// doSharedLock will take a shared lock on the given path, for operations that
+// only read the root and so may run alongside each other.
+func (m *Manager) doSharedLock(ctx context.Context, path, opType string) error {
+	return m.takeLock(ctx, path, opType, true)
+}
+
+// takeLock will lock the given path, waiting for it if requested
+func (m *Manager) takeLock(ctx context.Context, path, opType string, shared bool) error {
 	// Handle file locking
 	lock, err := NewLockFile(path)
 	if err != nil {
@@ -296,15 +631,53 @@ func (m *Manager) doLock(path, opType string) error {
 		}).Error("Failed to lock root for " + opType)
 		return err
 	}
+	lock.SetShared(shared)
 	m.lockfile = lock
 
-	if err = m.lockfile.Lock(); err != nil {
+	info := &LockInfo{
+		Operation: opType,
+		Started:   time.Now().UTC(),
+		User:      lockUser(),
+	}
+	if m.profile != nil {
+		info.Profile = m.profile.Name
+	}
+	if m.pkg != nil && m.pkg.Type != PackageTypeIndex {
+		info.Package = m.pkg.Name
+	}
+	m.lockfile.SetInfo(info)
+
+	if m.lockWait {
+		err = m.lockfile.LockWait(ctx, m.lockTimeout, func() {
+			log.WithFields(log.Fields{
+				"pid":     m.lockfile.GetOwnerPID(),
+				"process": m.lockfile.GetOwnerProcess(),
+			}).Info("Waiting for another process to release the lock")
+		})
+	} else {
+		err = m.lockfile.Lock()
+	}
+
+	if err != nil {
 		if err == ErrOwnedLockFile {
+			fields := log.Fields{
+				"error":   err,
+				"pid":     m.lockfile.GetOwnerPID(),
+				"process": m.lockfile.GetOwnerProcess(),
+			}
+			if owner := m.lockfile.GetOwnerInfo(); owner != nil && owner.Operation != "" {
+				fields["operation"] = owner.Operation
+				fields["user"] = owner.User
+				fields["started"] = owner.Started.Local().Format(time.RFC3339)
+			}
+			log.WithFields(fields).Error("Failed to lock root - another process is using it")
+		} else if err == ErrLockTimeout {
 			log.WithFields(log.Fields{
 				"error":   err,
 				"pid":     m.lockfile.GetOwnerPID(),
 				"process": m.lockfile.GetOwnerProcess(),
-			}).Error("Failed to lock root - another process is using it")
+				"timeout": m.lockTimeout,
+			}).Error("Failed to lock root - gave up waiting for another process")
 		} else {
 			log.WithFields(log.Fields{
 				"error": err,
@@ -317,23 +690,58 @@ func (m *Manager) doLock(path, opType string) error {
 	return nil
 }
 
-// SigIntCleanup will take care of cleaning up the build process.
-func (m *Manager) SigIntCleanup() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
+// setupCgroup will place the build in its own cgroup, applying any limits
+// from the config and profile.
+func (m *Manager) setupCgroup() error {
+	limits := m.Config.Limits.Merge(m.profile.Limits)
+	name := fmt.Sprintf("%s-%s", m.profile.Name, m.pkg.Name)
+	cg, err := NewCgroup(name, m.overlay.MountPoint, limits)
+	if err != nil {
+		// Accounting is nice to have, limits are not optional
+		if limits.IsSet() {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to apply resource limits")
+			return err
+		}
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Building without a cgroup")
+		return nil
+	}
+	m.cgroup = cg
+	return nil
+}
+
+// watchContext will tear down the current operation as soon as the context is
+// cancelled. The returned function must be called once the operation is over.
+func (m *Manager) watchContext(ctx context.Context) func() {
+	done := make(chan struct{})
 	go func() {
-		<-ch
-		log.Warning("CTRL+C interrupted, cleaning up")
-		m.SetCancelled()
-		m.Cleanup()
-		log.Error("Exiting due to interruption")
-		os.Exit(1)
+		select {
+		case <-ctx.Done():
+			log.Warning("Operation cancelled, cleaning up")
+			m.SetCancelled()
+			m.Cleanup()
+		case <-done:
+		}
 	}()
+	return func() { close(done) }
+}
+
+// opResult will translate the result of an operation, so that cancellation
+// is reported consistently regardless of which step was interrupted.
+func (m *Manager) opResult(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	return err
 }
 
 // Build will attempt to build the package associated with this manager,
-// automatically handling any required cleanups.
-func (m *Manager) Build() error {
+// automatically handling any required cleanups. Cancelling the context will
+// abort the build and tear down the build root.
+func (m *Manager) Build(ctx context.Context) (err error) {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -346,22 +754,158 @@ func (m *Manager) Build() error {
 	m.lock.Unlock()
 
 	// Now get on with the real work!
+	defer func() { m.closeLog(err) }()
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	defer m.watchContext(ctx)()
 
 	// Now set our options according to the config
 	m.overlay.EnableTmpfs = m.Config.EnableTmpfs
 	m.overlay.TmpfsSize = m.Config.TmpfsSize
 
-	if err := m.doLock(m.overlay.LockPath, "building"); err != nil {
-		return err
+	// Find out early if we can't publish
+	var publishRepo *Repo
+	if m.publish {
+		if publishRepo, err = m.profile.LocalRepo(m.publishRepo); err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"profile": m.profile.Name,
+			}).Error("Cannot publish packages")
+			return err
+		}
 	}
 
-	return m.pkg.Build(m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget)
+	if err := m.doLock(ctx, m.overlay.LockPath, "building"); err != nil {
+		return m.opResult(ctx, err)
+	}
+	m.startLog("building")
+
+	m.lock.Lock()
+	m.report = NewBuildReport(m.pkg, m.profile, m.image)
+	m.lock.Unlock()
+
+	start := time.Now()
+	m.Emit(&Event{
+		Kind:    EventBuildStarted,
+		Package: m.pkg.Name,
+		Time:    start,
+	})
+	defer func() {
+		now := time.Now()
+		m.Emit(&Event{
+			Kind:     EventBuildFinished,
+			Package:  m.pkg.Name,
+			Time:     now,
+			Duration: now.Sub(start),
+			Error:    err,
+		})
+		m.writeReport()
+	}()
+
+	// Find out about missing dependencies before doing any real work
+	if !m.skipDepsCheck {
+		if err = m.pkg.runPhase(m, PhaseCheckDeps, func(e *Event) error {
+			data, err := m.checkDeps()
+			e.Data = data
+			return err
+		}); err != nil {
+			return m.opResult(ctx, err)
+		}
+	}
+
+	if err = m.setupCgroup(); err != nil {
+		return m.opResult(ctx, err)
+	}
+
+	if m.buildTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		timer := time.AfterFunc(m.buildTimeout, func() { m.timeoutBuild(done) })
+		defer timer.Stop()
+	}
+
+	err = m.pkg.Build(ctx, m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget, m.Config.OutputDir)
+	if err == nil && publishRepo != nil {
+		err = m.pkg.runPhase(m, PhasePublish, func(e *Event) error {
+			m.lock.Lock()
+			files := m.artifacts
+			m.lock.Unlock()
+			data, err := m.pkg.Publish(ctx, publishRepo, files, m.Config.PublishRetain)
+			e.Data = data
+			return err
+		})
+	}
+	if err != nil && m.isTimedOut() {
+		return ErrTimedOut
+	}
+	return m.opResult(ctx, err)
+}
+
+// writeReport will write the report of the build alongside the collected
+// build artifacts. Failing to do so won't fail the build.
+func (m *Manager) writeReport() {
+	m.lock.Lock()
+	report := m.report
+	m.report = nil
+	m.lock.Unlock()
+	if report == nil {
+		return
+	}
+	usr := GetUserInfo()
+	dir, err := PrepareOutputDir(m.Config.OutputDir, usr)
+	if err != nil {
+		return
+	}
+	path, err := report.Write(dir, usr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  path,
+		}).Warning("Failed to write build report")
+		return
+	}
+	log.WithFields(log.Fields{
+		"path": path,
+	}).Debug("Wrote build report")
+}
+
+// timeoutBuild is called when the build exceeds its time limit. The active
+// process group is asked to terminate first, and if the build still hasn't
+// given up after the grace period, everything is torn down forcibly.
+func (m *Manager) timeoutBuild(done chan struct{}) {
+	m.lock.Lock()
+	m.timedOut = true
+	pid := m.activePID
+	m.lock.Unlock()
+
+	log.WithFields(log.Fields{
+		"timeout": m.buildTimeout,
+	}).Error("Build exceeded its time limit, terminating")
+	if pid > 0 {
+		syscall.Kill(-pid, syscall.SIGTERM)
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(BuildTimeoutGrace):
+	}
+
+	log.WithFields(log.Fields{
+		"grace": BuildTimeoutGrace,
+	}).Warning("Build failed to terminate, cleaning up")
+	m.SetCancelled()
+	m.Cleanup()
+}
+
+// isTimedOut will determine if the build hit its time limit
+func (m *Manager) isTimedOut() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.timedOut
 }
 
 // Chroot will enter the build environment to allow users to introspect it
-func (m *Manager) Chroot() error {
+func (m *Manager) Chroot(ctx context.Context) error {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -375,17 +919,17 @@ func (m *Manager) Chroot() error {
 
 	// Now get on with the real work!
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	defer m.watchContext(ctx)()
 
-	if err := m.doLock(m.overlay.LockPath, "chroot"); err != nil {
-		return err
+	if err := m.doLock(ctx, m.overlay.LockPath, "chroot"); err != nil {
+		return m.opResult(ctx, err)
 	}
 
-	return m.pkg.Chroot(m, m.pkgManager, m.overlay)
+	return m.opResult(ctx, m.pkg.Chroot(m, m.pkgManager, m.overlay))
 }
 
 // Update will attempt to update the base image
-func (m *Manager) Update() error {
+func (m *Manager) Update(ctx context.Context) (err error) {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -402,42 +946,85 @@ func (m *Manager) Update() error {
 	m.pkgManager = NewEopkgManager(m, m.image.RootDir)
 	m.lock.Unlock()
 
+	defer func() { m.closeLog(err) }()
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	defer m.watchContext(ctx)()
 
-	if err := m.doLock(m.image.LockPath, "updating"); err != nil {
-		return err
+	if err := m.doLock(ctx, m.image.LockPath, "updating"); err != nil {
+		return m.opResult(ctx, err)
 	}
+	m.startLog("updating")
 
-	return m.image.Update(m, m.pkgManager)
+	return m.opResult(ctx, m.image.Update(m, m.pkgManager))
 }
 
-// Index will attempt to index the given directory for eopkgs
-func (m *Manager) Index(dir string) error {
+// Index will generate the eopkg index for the given directory. This no longer
+// requires a build root, so neither a profile nor a package need to be set.
+// If a profile is set and the directory is one of its local repos, the index
+// is signed with that repo's signing_key unless SetSigningKey overrides it.
+func (m *Manager) Index(ctx context.Context, dir string) (err error) {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	if err = checkIndexDir(dir); err != nil {
+		return err
+	}
+
+	defer func() { m.closeLog(err) }()
+	defer m.Cleanup()
+
+	if err := m.doLock(ctx, IndexLockPath(dir), "indexing"); err != nil {
+		return m.opResult(ctx, err)
+	}
+	m.startLog("indexing")
 
+	return m.opResult(ctx, IndexDir(ctx, dir, m.indexSigningKey(dir)))
+}
+
+// Query will answer the query from the repository indexes of the profile on
+// the host. The backing image is only mounted read-only to read the indexes
+// cached within it, so no build root is brought up.
+func (m *Manager) Query(ctx context.Context, q *Query) ([]*QueryResult, error) {
+	if m.IsCancelled() {
+		return nil, ErrInterrupted
+	}
 	m.lock.Lock()
-	if m.pkg == nil {
+	if m.image == nil {
 		m.lock.Unlock()
-		return ErrNoPackage
+		return nil, ErrInvalidProfile
 	}
 	m.lock.Unlock()
 
-	// Now get on with the real work!
 	defer m.Cleanup()
-	m.SigIntCleanup()
-
-	// Now set our options according to the config
-	m.overlay.EnableTmpfs = m.Config.EnableTmpfs
-	m.overlay.TmpfsSize = m.Config.TmpfsSize
 
-	if err := m.doLock(m.overlay.LockPath, "indexing"); err != nil {
-		return err
+	root := ""
+	if m.image.IsInstalled() {
+		// Don't read the image while it is being updated, other queries
+		// and builds are fine
+		if err := m.doSharedLock(ctx, m.image.LockPath, "querying"); err != nil {
+			return nil, m.opResult(ctx, err)
+		}
+		dir, err := ioutil.TempDir("", "solbuild-query")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(dir)
+		if err := m.image.mountReadOnly(dir); err != nil {
+			return nil, err
+		}
+		defer disk.GetMountManager().Unmount(dir)
+		root = dir
+	} else {
+		log.WithFields(log.Fields{
+			"profile": m.profile.Name,
+		}).Warning("Profile is not installed, only local repositories will be searched")
 	}
 
-	return m.pkg.Index(m, dir, m.overlay)
+	results, err := RunQuery(m.profile.QuerySources(root), q)
+	return results, m.opResult(ctx, err)
 }
 
 // SetTmpfs sets the manager tmpfs option
@@ -0,0 +1,194 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// MountInfoPath is where the kernel exposes the mount table for our namespace
+	MountInfoPath = "/proc/self/mountinfo"
+
+	// UnmountRetries is how many times we'll try a normal unmount before
+	// falling back to a lazy detach
+	UnmountRetries = 3
+
+	// UnmountRetryInterval is how long we'll wait between unmount attempts
+	UnmountRetryInterval = 500 * time.Millisecond
+)
+
+// A MountInfo describes a single entry in the kernel mount table
+type MountInfo struct {
+	ID         int    // Unique ID for the mount
+	ParentID   int    // ID of the parent mount
+	Root       string // Root of the mount within the filesystem
+	MountPoint string // Mount point relative to our root
+	Options    string // Per-mount options
+	FSType     string // Filesystem type, i.e. overlay
+	Source     string // Filesystem specific source, i.e. /dev/loop0
+}
+
+// unescapeMountPath will undo the octal escaping the kernel applies to
+// spaces, tabs, newlines and backslashes in mountinfo paths.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// ParseMountInfo will parse a mount table in the format of /proc/self/mountinfo
+func ParseMountInfo(r io.Reader) ([]*MountInfo, error) {
+	var mounts []*MountInfo
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Optional fields are terminated by a lone hyphen
+		halves := strings.SplitN(line, " - ", 2)
+		if len(halves) != 2 {
+			return nil, fmt.Errorf("invalid mountinfo line: %s", line)
+		}
+		pre := strings.Fields(halves[0])
+		post := strings.Fields(halves[1])
+		if len(pre) < 6 || len(post) < 2 {
+			return nil, fmt.Errorf("invalid mountinfo line: %s", line)
+		}
+		id, err := strconv.Atoi(pre[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount ID in line: %s", line)
+		}
+		parent, err := strconv.Atoi(pre[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent ID in line: %s", line)
+		}
+		mounts = append(mounts, &MountInfo{
+			ID:         id,
+			ParentID:   parent,
+			Root:       unescapeMountPath(pre[3]),
+			MountPoint: unescapeMountPath(pre[4]),
+			Options:    pre[5],
+			FSType:     post[0],
+			Source:     unescapeMountPath(post[1]),
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// ReadMountInfo will read the current mount table for our mount namespace
+func ReadMountInfo() ([]*MountInfo, error) {
+	fi, err := os.Open(MountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	return ParseMountInfo(fi)
+}
+
+// MountsUnder will return all mounts at or below the given root, ordered
+// deepest first so that they may be unmounted in order.
+func MountsUnder(mounts []*MountInfo, root string) []*MountInfo {
+	root = filepath.Clean(root)
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	var ret []*MountInfo
+	for _, m := range mounts {
+		if m.MountPoint == root || strings.HasPrefix(m.MountPoint, root+"/") {
+			ret = append(ret, m)
+		}
+	}
+	// Deepest first, and the most recent mount first when stacked
+	sort.SliceStable(ret, func(i, j int) bool {
+		di := strings.Count(ret[i].MountPoint, "/")
+		dj := strings.Count(ret[j].MountPoint, "/")
+		if di != dj {
+			return di > dj
+		}
+		return ret[i].ID > ret[j].ID
+	})
+	return ret
+}
+
+// IsMounted will determine whether anything is mounted at the given path
+func IsMounted(path string) (bool, error) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return false, err
+	}
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	for _, m := range mounts {
+		if m.MountPoint == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UnmountPath will unmount the given path, retrying a few times whilst it
+// is busy before finally detaching it lazily.
+func UnmountPath(path string) error {
+	var err error
+	for i := 0; i < UnmountRetries; i++ {
+		if err = syscall.Unmount(path, 0); err == nil || err == syscall.EINVAL || err == syscall.ENOENT {
+			// Not mounted (anymore) is just fine
+			return nil
+		}
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(UnmountRetryInterval)
+	}
+	log.WithFields(log.Fields{
+		"point": path,
+		"error": err,
+	}).Warning("Unmount failed, attempting lazy detach")
+	if err = syscall.Unmount(path, syscall.MNT_DETACH); err == nil || err == syscall.EINVAL {
+		return nil
+	}
+	return err
+}
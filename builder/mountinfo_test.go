@@ -0,0 +1,78 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+98 22 0:48 / /var/cache/solbuild/main-x86_64/nano rw,relatime shared:50 - tmpfs tmpfs-root rw,size=4G
+99 98 7:0 / /var/cache/solbuild/main-x86_64/nano/img ro,relatime shared:51 - ext4 /dev/loop0 ro
+100 98 0:49 / /var/cache/solbuild/main-x86_64/nano/union rw,relatime shared:52 - overlay overlay rw,lowerdir=img
+101 100 0:5 / /var/cache/solbuild/main-x86_64/nano/union/dev rw,nosuid shared:53 - devtmpfs devtmpfs rw,mode=755
+102 101 0:50 / /var/cache/solbuild/main-x86_64/nano/union/dev/pts rw,nosuid,noexec shared:54 - devpts devpts rw,gid=5
+103 100 259:2 /home/user/My\040Sources /var/cache/solbuild/main-x86_64/nano/union/home/build/YPKG/root/My\040Sources rw shared:1 - ext4 /dev/nvme0n1p2 rw
+104 22 0:51 / /var/cache/solbuild/main-x86_64/nanox rw,relatime shared:55 - tmpfs tmpfs-root rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatalf("Failed to parse mountinfo: %v", err)
+	}
+	if len(mounts) != 8 {
+		t.Fatalf("Expected 8 mounts, got %d", len(mounts))
+	}
+	bind := mounts[6]
+	if bind.Root != "/home/user/My Sources" {
+		t.Fatalf("Failed to unescape mount root: %s", bind.Root)
+	}
+	if bind.MountPoint != "/var/cache/solbuild/main-x86_64/nano/union/home/build/YPKG/root/My Sources" {
+		t.Fatalf("Failed to unescape mount point: %s", bind.MountPoint)
+	}
+	if mounts[2].FSType != "ext4" || mounts[2].Source != "/dev/loop0" || mounts[2].ParentID != 98 {
+		t.Fatalf("Invalid mount entry: %+v", mounts[2])
+	}
+
+	under := MountsUnder(mounts, "/var/cache/solbuild/main-x86_64/nano")
+	if len(under) != 6 {
+		t.Fatalf("Expected 6 mounts under overlay, got %d", len(under))
+	}
+	if under[0].ID != 103 || under[len(under)-1].ID != 98 {
+		t.Fatalf("Mounts not ordered deepest first: %d .. %d", under[0].ID, under[len(under)-1].ID)
+	}
+	for i := 1; i < len(under); i++ {
+		if strings.Count(under[i].MountPoint, "/") > strings.Count(under[i-1].MountPoint, "/") {
+			t.Fatalf("Mount %s unmounted before its child %s", under[i-1].MountPoint, under[i].MountPoint)
+		}
+	}
+
+	if _, err = ParseMountInfo(strings.NewReader("garbage\n")); err == nil {
+		t.Fatal("Should fail to parse invalid mountinfo")
+	}
+}
+
+func TestIsMounted(t *testing.T) {
+	if mounted, err := IsMounted("/proc"); err != nil || !mounted {
+		t.Fatalf("/proc should be mounted, got %v: %v", mounted, err)
+	}
+	if mounted, err := IsMounted("/proc/self"); err != nil || mounted {
+		t.Fatalf("/proc/self should not be a mount point, got %v: %v", mounted, err)
+	}
+}
@@ -17,7 +17,10 @@
 package builder
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
 	"syscall"
 )
 
@@ -44,3 +47,35 @@ func DropNetworking() error {
 	}
 	return nil
 }
+
+// SaveNetworking will remember the current network namespaces of the calling
+// thread, returning a function to restore them, undoing DropNetworking. This
+// allows a long lived process to carry out many builds.
+func SaveNetworking() (func() error, error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, ns := range []string{"net", "uts"} {
+		f, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/%s", syscall.Gettid(), ns))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return func() error {
+		defer closeAll()
+		for i, flag := range []int{syscall.CLONE_NEWNET, syscall.CLONE_NEWUTS} {
+			if err := unix.Setns(int(files[i].Fd()), flag); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to restore networking")
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
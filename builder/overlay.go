@@ -18,11 +18,11 @@ package builder
 
 import (
 	"fmt"
-	"github.com/getsolus/libosdev/commands"
 	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // An Overlay is formed from a backing image & Package combination.
@@ -42,12 +42,7 @@ type Overlay struct {
 	EnableTmpfs bool   // Whether to use tmpfs for the upperdir or not
 	TmpfsSize   string // Size of the tmpfs to pass to mount, string form
 
-	ExtraMounts []string // Any extra mounts to take care of when cleaning up
-
-	mountedImg     bool // Whether we mounted the image or not
-	mountedOverlay bool // Whether we mounted the overlay or not
-	mountedVFS     bool // Whether we mounted vfs or not
-	mountedTmpfs   bool // Whether we mounted tmpfs or not
+	pidNS *PidNamespace // PID namespace for processes within the root
 }
 
 // NewOverlay creates a new Overlay for us in builds, etc.
@@ -60,20 +55,16 @@ func NewOverlay(config *Config, profile *Profile, back *BackingImage, pkg *Packa
 	// i.e. /var/cache/solbuild/unstable-x86_64/nano
 	basedir := filepath.Join(config.OverlayRootDir, profile.Name, dirname)
 	return &Overlay{
-		Back:           back,
-		Package:        pkg,
-		BaseDir:        basedir,
-		WorkDir:        filepath.Join(basedir, "work"),
-		UpperDir:       filepath.Join(basedir, "tmp"),
-		ImgDir:         filepath.Join(basedir, "img"),
-		MountPoint:     filepath.Join(basedir, "union"),
-		LockPath:       fmt.Sprintf("%s.lock", basedir),
-		mountedImg:     false,
-		mountedOverlay: false,
-		mountedVFS:     false,
-		EnableTmpfs:    false,
-		TmpfsSize:      "",
-		mountedTmpfs:   false,
+		Back:        back,
+		Package:     pkg,
+		BaseDir:     basedir,
+		WorkDir:     filepath.Join(basedir, "work"),
+		UpperDir:    filepath.Join(basedir, "tmp"),
+		ImgDir:      filepath.Join(basedir, "img"),
+		MountPoint:  filepath.Join(basedir, "union"),
+		LockPath:    fmt.Sprintf("%s.lock", basedir),
+		EnableTmpfs: false,
+		TmpfsSize:   "",
 	}
 }
 
@@ -138,7 +129,7 @@ func (o *Overlay) Mount() error {
 				"dir":   o.BaseDir,
 				"error": err,
 			}).Error("Failed to create tmpfs directory")
-			return nil
+			return err
 		}
 
 		log.WithFields(log.Fields{
@@ -179,7 +170,6 @@ func (o *Overlay) Mount() error {
 		}).Error("Failed to mount backing image")
 		return err
 	}
-	o.mountedImg = true
 
 	// Now mount the overlayfs
 	log.WithFields(log.Fields{
@@ -203,54 +193,66 @@ func (o *Overlay) Mount() error {
 		}).Error("Failed to mount overlayfs")
 		return err
 	}
-	o.mountedOverlay = true
 
 	// Must be done here before we do any more overlayfs work
 	return EnsureEopkgLayout(o.MountPoint)
 }
 
-// Unmount will tear down the overlay mount again
+// Unmount will tear down every mount beneath the overlay's BaseDir, as found
+// in the kernel mount table, deepest first. Once complete the mount table is
+// checked again, and an error is returned listing anything left behind.
 func (o *Overlay) Unmount() error {
 	mountMan := disk.GetMountManager()
 
-	for _, m := range o.ExtraMounts {
-		mountMan.Unmount(m)
+	// Killing the namespace init takes every process in the root with it
+	if o.pidNS != nil {
+		o.pidNS.Stop()
+		o.pidNS = nil
 	}
-	o.ExtraMounts = nil
 
-	vfsPoints := []string{
-		filepath.Join(o.MountPoint, "dev/pts"),
-		filepath.Join(o.MountPoint, "dev/shm"),
-		filepath.Join(o.MountPoint, "dev"),
-		filepath.Join(o.MountPoint, "proc"),
-		filepath.Join(o.MountPoint, "sys"),
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return err
 	}
-	if o.mountedVFS {
-		for _, p := range vfsPoints {
-			mountMan.Unmount(p)
-		}
-		o.mountedVFS = false
+
+	// mountinfo has resolved paths, MountManager has the ones we gave it
+	resolved := o.BaseDir
+	if p, err := filepath.EvalSymlinks(o.BaseDir); err == nil {
+		resolved = p
 	}
 
-	if o.mountedImg {
-		if err := mountMan.Unmount(o.ImgDir); err != nil {
-			return err
+	for _, m := range MountsUnder(mounts, o.BaseDir) {
+		point := filepath.Join(o.BaseDir, strings.TrimPrefix(m.MountPoint, resolved))
+		log.WithFields(log.Fields{
+			"point": point,
+			"type":  m.FSType,
+		}).Debug("Unmounting overlay mount")
+
+		// Let MountManager handle its own mounts to keep it in sync
+		if err := mountMan.Unmount(point); err == nil {
+			continue
 		}
-		o.mountedImg = false
-	}
-	if o.mountedOverlay {
-		if err := mountMan.Unmount(o.MountPoint); err != nil {
-			return err
+		if err := UnmountPath(point); err != nil {
+			log.WithFields(log.Fields{
+				"point": point,
+				"error": err,
+			}).Error("Failed to unmount overlay mount")
 		}
-		o.mountedOverlay = false
 	}
-	if o.mountedTmpfs {
-		if err := mountMan.Unmount(o.UpperDir); err != nil {
-			return err
-		}
-		o.mountedTmpfs = false
+
+	// Make sure it actually all went away
+	if mounts, err = ReadMountInfo(); err != nil {
+		return err
 	}
-	return nil
+	remaining := MountsUnder(mounts, o.BaseDir)
+	if len(remaining) == 0 {
+		return nil
+	}
+	var points []string
+	for _, m := range remaining {
+		points = append(points, m.MountPoint)
+	}
+	return fmt.Errorf("failed to unmount %d mount(s) under %s: %s", len(points), o.BaseDir, strings.Join(points, ", "))
 }
 
 // MountVFS will bring up virtual filesystems within the chroot
@@ -292,7 +294,6 @@ func (o *Overlay) MountVFS() error {
 		}).Error("Failed to mount /dev")
 		return err
 	}
-	o.mountedVFS = true
 
 	// Bring up dev/pts
 	log.WithFields(log.Fields{
@@ -305,16 +306,18 @@ func (o *Overlay) MountVFS() error {
 		return err
 	}
 
-	// Bring up proc
+	// Bring up proc, from within a fresh PID namespace for the root
 	log.WithFields(log.Fields{
 		"vfs": "/proc",
 	}).Debug("Mounting vfs")
-	if err := mountMan.Mount("proc", vfsPoints[2], "proc", "nosuid", "noexec"); err != nil {
+	pidNS, err := StartPidNamespace(o.MountPoint)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to mount /proc")
 		return err
 	}
+	o.pidNS = pidNS
 
 	// Bring up sys
 	log.WithFields(log.Fields{
@@ -342,10 +345,10 @@ func (o *Overlay) MountVFS() error {
 
 // ConfigureNetworking will add a loopback interface to the container so
 // that localhost networking will still work
-func (o *Overlay) ConfigureNetworking() error {
+func (o *Overlay) ConfigureNetworking(notif PidNotifier) error {
 	ipCommand := "/sbin/ip link set lo up"
 	log.Debug("Configuring container networking")
-	if err := commands.ChrootExec(o.MountPoint, ipCommand); err != nil {
+	if err := ChrootExec(notif, o.MountPoint, ipCommand); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to configure networking")
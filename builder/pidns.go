@@ -0,0 +1,221 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// ReaperName is the name solbuild is re-executed as to act as the init
+	// process of a build's PID namespace
+	ReaperName = "solbuild-reaper"
+
+	// reaperReady is sent by the reaper once /proc is mounted
+	reaperReady = "ready"
+)
+
+var (
+	// ErrReaperFailed is returned when the PID namespace init could not start
+	ErrReaperFailed = errors.New("Failed to start PID namespace reaper")
+
+	pidNamespaces     = make(map[string]*PidNamespace)
+	pidNamespacesLock sync.Mutex
+)
+
+func init() {
+	if filepath.Base(os.Args[0]) == ReaperName {
+		os.Exit(reaperMain(os.Args[1:]))
+	}
+}
+
+// A PidNamespace is a fresh PID namespace for all processes within a root.
+// Its init process reaps orphans, and when it is killed the kernel will kill
+// every remaining process in the namespace, no matter where they wandered off.
+type PidNamespace struct {
+	Root string    // The root the namespace serves
+	cmd  *exec.Cmd // The reaper process, PID 1 in the namespace
+}
+
+// StartPidNamespace will spawn a reaper in a new PID namespace for the given
+// root, which mounts a fresh /proc inside the root for the namespace.
+func StartPidNamespace(root string) (*PidNamespace, error) {
+	procPoint := filepath.Join(root, "proc")
+
+	c := exec.Command("/proc/self/exe", procPoint)
+	c.Args[0] = ReaperName
+	c.Stderr = os.Stderr
+	// Pdeathsig would be tied to the thread that starts the reaper, not to
+	// solbuild, so the reaper watches its stdin instead. We hold the only
+	// write end, which the kernel closes however solbuild goes away.
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID,
+		Setsid:     true,
+	}
+	if _, err := c.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Start(); err != nil {
+		return nil, err
+	}
+
+	// Wait for /proc to come up before anything runs in the namespace
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != reaperReady {
+		c.Process.Kill()
+		c.Wait()
+		return nil, ErrReaperFailed
+	}
+
+	ns := &PidNamespace{
+		Root: root,
+		cmd:  c,
+	}
+	if cg := cgroupFor(root); cg != nil {
+		if err = cg.AddProcess(c.Process.Pid); err != nil {
+			c.Process.Kill()
+			c.Wait()
+			return nil, err
+		}
+	}
+	pidNamespacesLock.Lock()
+	pidNamespaces[root] = ns
+	pidNamespacesLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"root": root,
+		"pid":  c.Process.Pid,
+	}).Debug("Started PID namespace")
+	return ns, nil
+}
+
+// Pid will return the host PID of the namespace init process
+func (p *PidNamespace) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+// Stop will kill the namespace init, and with it, every process within the
+// namespace.
+func (p *PidNamespace) Stop() {
+	pidNamespacesLock.Lock()
+	delete(pidNamespaces, p.Root)
+	pidNamespacesLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"root": p.Root,
+		"pid":  p.Pid(),
+	}).Debug("Stopping PID namespace")
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// pidNamespaceFor will return the PID namespace for the given root, if any
+func pidNamespaceFor(root string) *PidNamespace {
+	pidNamespacesLock.Lock()
+	defer pidNamespacesLock.Unlock()
+	return pidNamespaces[root]
+}
+
+// chrootCommand will return a command to run the given args chroot'd into
+// dir, within the root's PID namespace if it has one.
+func chrootCommand(dir string, args ...string) *exec.Cmd {
+	chroot, err := exec.LookPath("chroot")
+	if err != nil {
+		chroot = "chroot"
+	}
+	args = append([]string{chroot, dir}, args...)
+	if ns := pidNamespaceFor(dir); ns != nil {
+		args = append([]string{"nsenter", "--target", fmt.Sprintf("%d", ns.Pid()), "--pid", "--"}, args...)
+	}
+	// Join the cgroup before anything is spawned, so nothing can escape it
+	if cg := cgroupFor(dir); cg != nil {
+		args = append([]string{"/bin/sh", "-c", `echo $$ > "$0" && exec "$@"`, cg.ProcsFile()}, args...)
+	}
+	return exec.Command(args[0], args[1:]...)
+}
+
+// killInRoot will kill the given PID, which is relative to the root's PID
+// namespace if it has one.
+func killInRoot(notif PidNotifier, root, pid string) error {
+	c := exec.Command("kill", "-9", pid)
+	if ns := pidNamespaceFor(root); ns != nil {
+		c = exec.Command("nsenter", "--target", fmt.Sprintf("%d", ns.Pid()), "--pid", "--", "kill", "-9", pid)
+	}
+	c.Stdout, c.Stderr = outputFor(notif)
+	return c.Run()
+}
+
+// reaperMain is the entry point for the PID namespace init. It will mount
+// /proc at the given path, signal readiness and then reap any children that
+// are reparented to it, until it is killed or solbuild goes away.
+func reaperMain(args []string) int {
+	if len(args) != 1 || os.Getpid() != 1 {
+		fmt.Fprintf(os.Stderr, "%s must be started by solbuild\n", ReaperName)
+		return 1
+	}
+	if err := os.MkdirAll(args[0], 00755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", args[0], err)
+		return 1
+	}
+	if err := syscall.Mount("proc", args[0], "proc", syscall.MS_NOSUID|syscall.MS_NOEXEC, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mount /proc: %v\n", err)
+		return 1
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGCHLD)
+
+	fmt.Fprintln(os.Stdout, reaperReady)
+	os.Stdout.Close()
+
+	// Once stdin is closed solbuild is gone, and the kernel will take the
+	// rest of the namespace down with us
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		os.Exit(1)
+	}()
+
+	for {
+		for {
+			var ws syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			if pid <= 0 {
+				break
+			}
+		}
+		<-ch
+	}
+}
@@ -0,0 +1,222 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EopkgBlacklist lists the packages that eopkg will not upgrade, relative
+	// to the root
+	EopkgBlacklist = "etc/eopkg/blacklist"
+)
+
+// findPinnedFile will find the package within the local repo directory, at
+// the given release or the newest if release is 0, returning its file name.
+func findPinnedFile(dir, name string, release int) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+EopkgSuffix))
+	if err != nil {
+		return "", err
+	}
+	var found *EopkgFile
+	for _, path := range paths {
+		f, err := ParseEopkgFilename(path)
+		if err != nil || f.Name != name {
+			continue
+		}
+		if release > 0 && f.Release != release {
+			continue
+		}
+		if found == nil || f.Release > found.Release || (f.Release == found.Release && f.Build > found.Build) {
+			found = f
+		}
+	}
+	if found == nil {
+		return "", nil
+	}
+	return filepath.Base(found.Path), nil
+}
+
+// installedRelease will return the release of the package installed within
+// the root, or 0 if it isn't installed.
+func installedRelease(root, name string) int {
+	dirs, _ := filepath.Glob(filepath.Join(root, "var", "lib", "eopkg", "package", name+"-*"))
+	for _, dir := range dirs {
+		// name-version-release, where the name may contain dashes
+		fields := strings.Split(filepath.Base(dir), "-")
+		if len(fields) < 3 || strings.Join(fields[:len(fields)-2], "-") != name {
+			continue
+		}
+		if release, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+			return release
+		}
+	}
+	return 0
+}
+
+// pinSource will find where the pinned package should be installed from, as
+// a path within the root or a URL. An empty string means the installed
+// package already satisfies the pin.
+func (p *Package) pinSource(o *Overlay, pkgManager *EopkgManager, profile *Profile, pin *Pin) (string, error) {
+	if pin.Repo == "" {
+		if installedRelease(o.MountPoint, pin.Name) == pin.Release {
+			return "", nil
+		}
+		// Only local repos keep older releases around
+		for _, repo := range profile.ReposToAdd() {
+			if !repo.Local {
+				continue
+			}
+			file, err := findPinnedFile(repo.URI, pin.Name, pin.Release)
+			if err != nil {
+				return "", err
+			}
+			if file != "" {
+				return filepath.Join(BindRepoDir, repo.Name, file), nil
+			}
+		}
+		return "", fmt.Errorf("Release %d of %s is not installed or in a local repo", pin.Release, pin.Name)
+	}
+
+	if repo, ok := profile.Repos[pin.Repo]; ok && repo.Local {
+		file, err := findPinnedFile(repo.URI, pin.Name, pin.Release)
+		if err != nil {
+			return "", err
+		}
+		if file == "" {
+			return "", fmt.Errorf("%s is not in the local repo %s", pin.Name, pin.Repo)
+		}
+		// The repo may not have been added, but it must still be visible
+		chrootDir, err := p.mountLocalRepo(o, repo)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(chrootDir, file), nil
+	}
+
+	// Remote repos are looked up in the index eopkg fetched into the root
+	repos, err := pkgManager.GetRepos()
+	if err != nil {
+		return "", err
+	}
+	var uri string
+	for _, r := range repos {
+		if r.ID == pin.Repo {
+			uri = strings.TrimSpace(r.URI)
+		}
+	}
+	index := findIndex(filepath.Join(o.MountPoint, "var", "lib", "eopkg", "index", pin.Repo))
+	if uri == "" || index == "" {
+		return "", fmt.Errorf("The pinned repo %s is not enabled", pin.Repo)
+	}
+	source := &QuerySource{Repo: pin.Repo, Index: index}
+	results, err := source.Query(&Query{Kind: QueryPackage, Term: pin.Name})
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "", fmt.Errorf("%s is not in the repo %s", pin.Name, pin.Repo)
+	}
+	if pin.Release > 0 && results[0].Release != pin.Release {
+		return "", fmt.Errorf("Release %d of %s is not available from %s, only %d", pin.Release, pin.Name, pin.Repo, results[0].Release)
+	}
+	return uri[:strings.LastIndex(uri, "/")+1] + results[0].URI, nil
+}
+
+// writeBlacklist will add the packages to the eopkg blacklist of the root, so
+// that upgrades leave them alone.
+func writeBlacklist(root string, names []string) error {
+	path := filepath.Join(root, EopkgBlacklist)
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		listed[strings.TrimSpace(line)] = true
+	}
+	content := string(b)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	for _, name := range names {
+		if !listed[name] {
+			listed[name] = true
+			content += name + "\n"
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 00755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(content), 00644)
+}
+
+// applyPins will install each pinned package from its pinned repo or release,
+// and then hold them so that the upgrade doesn't replace them. The names of
+// the pinned packages are returned.
+func (p *Package) applyPins(o *Overlay, pkgManager *EopkgManager, profile *Profile) ([]string, error) {
+	if len(profile.Pins) == 0 {
+		return nil, nil
+	}
+	var names []string
+	for name := range profile.Pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var install []string
+	for _, name := range names {
+		pin := profile.Pins[name]
+		src, err := p.pinSource(o, pkgManager, profile, pin)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"package": name,
+				"repo":    pin.Repo,
+				"release": pin.Release,
+				"error":   err,
+			}).Error("Failed to resolve pinned package")
+			return nil, err
+		}
+		if src != "" {
+			install = append(install, src)
+		}
+	}
+
+	if len(install) > 0 {
+		log.WithFields(log.Fields{
+			"packages": strings.Join(install, ", "),
+		}).Debug("Installing pinned packages")
+		if err := pkgManager.InstallPackages(install); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeBlacklist(o.MountPoint, names); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to hold pinned packages")
+		return nil, err
+	}
+	return names, nil
+}
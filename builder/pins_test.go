@@ -0,0 +1,68 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindPinnedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-pins")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{
+		"mesa-21.0.1-150-1-x86_64.eopkg",
+		"mesa-21.0.2-151-1-x86_64.eopkg",
+		"mesa-demos-8.4.0-20-1-x86_64.eopkg",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 00644); err != nil {
+			t.Fatalf("Failed to write %s: %v", f, err)
+		}
+	}
+	if f, _ := findPinnedFile(dir, "mesa", 0); f != "mesa-21.0.2-151-1-x86_64.eopkg" {
+		t.Fatalf("Should find the newest mesa, got %s", f)
+	}
+	if f, _ := findPinnedFile(dir, "mesa", 150); f != "mesa-21.0.1-150-1-x86_64.eopkg" {
+		t.Fatalf("Should find the pinned release, got %s", f)
+	}
+	if f, _ := findPinnedFile(dir, "mesa", 20); f != "" {
+		t.Fatalf("Should not match another package, got %s", f)
+	}
+
+	installed := filepath.Join(dir, "var", "lib", "eopkg", "package")
+	os.MkdirAll(filepath.Join(installed, "mesa-demos-8.4.0-20"), 00755)
+	os.MkdirAll(filepath.Join(installed, "mesa-21.0.1-150"), 00755)
+	if release := installedRelease(dir, "mesa"); release != 150 {
+		t.Fatalf("Expected release 150 of mesa installed, got %d", release)
+	}
+
+	if err = writeBlacklist(dir, []string{"mesa", "mesa"}); err != nil {
+		t.Fatalf("Failed to write blacklist: %v", err)
+	}
+	if err = writeBlacklist(dir, []string{"mesa", "llvm"}); err != nil {
+		t.Fatalf("Failed to update blacklist: %v", err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, EopkgBlacklist))
+	if string(b) != "mesa\nllvm\n" {
+		t.Fatalf("Invalid blacklist: %q", b)
+	}
+}
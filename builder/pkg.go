@@ -42,8 +42,9 @@ const (
 )
 
 var (
-	// IndexPackage is used by the index command to make use of the overlayfs
-	// system.
+	// IndexPackage was used by the index command to make use of the overlayfs
+	// system. Indexing no longer needs a build root, so this is only retained
+	// for compatibility.
 	IndexPackage = Package{
 		Name:    "index",
 		Version: "1.4.5.2",
@@ -62,6 +63,7 @@ type Package struct {
 	Path       string          // Path to the build spec
 	Sources    []source.Source // Each package has 0 or more sources that we fetch
 	CanNetwork bool            // Only applicable to ypkg builds
+	BuildDeps  []string        // Build dependencies, only known for ypkg builds
 }
 
 // YmlPackage is a parsed ypkg build file
@@ -71,6 +73,7 @@ type YmlPackage struct {
 	Release    int
 	Networking bool // If set to false (default) we disable networking in the build
 	Source     []map[string]string
+	BuildDeps  []string
 }
 
 // XMLUpdate represents an update in the package history
@@ -208,6 +211,12 @@ func NewYmlPackageFromBytes(by []byte) (*Package, error) {
 		CanNetwork: ypkg.Networking,
 	}
 
+	for _, dep := range ypkg.BuildDeps {
+		if dep = strings.TrimSpace(dep); dep != "" {
+			ret.BuildDeps = append(ret.BuildDeps, dep)
+		}
+	}
+
 	for _, row := range ypkg.Source {
 		for key, value := range row {
 			source, err := source.New(key, value, false)
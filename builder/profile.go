@@ -22,26 +22,46 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 // A Repo is a definition of a repository to add to the eopkg root during
 // the build process.
 type Repo struct {
-	Name      string `toml:"-"`         // Name of the repo, set by implementation not yoml
-	URI       string `toml:"uri"`       // URI of the repository
-	Local     bool   `toml:"local"`     // Local repository for bindmounting
-	AutoIndex bool   `toml:"autoindex"` // Enable automatic indexing of the repo
+	Name          string `toml:"-"`                        // Name of the repo, set by implementation not yoml
+	URI           string `toml:"uri"`                      // URI of the repository
+	Local         bool   `toml:"local,omitempty"`          // Local repository for bindmounting
+	AutoIndex     bool   `toml:"autoindex,omitempty"`      // Enable automatic indexing of the repo
+	SigningKey    string `toml:"signing_key,omitempty"`    // gpg key used to sign the index of a local repo
+	VerifyKeyring string `toml:"verify_keyring,omitempty"` // Keyring used to verify the index of a local repo
+	Priority      int    `toml:"priority,omitzero"`        // Higher priority repos are preferred by eopkg
+
+	path string // File the repo was defined in
+}
+
+// A Pin forces a package to come from a given repository, or holds it at a
+// given release, within the build root.
+type Pin struct {
+	Name    string `toml:"-"`                // Name of the package, set by implementation not toml
+	Repo    string `toml:"repo,omitempty"`   // Repository the package must come from
+	Release int    `toml:"release,omitzero"` // Release the package is held at
 }
 
 // A Profile is a configuration defining what backing image to use, what repos
 // to add, etc.
 type Profile struct {
-	AddRepos    []string         `toml:"add_repos"`    // Allow locking to a single set of repos
-	Image       string           `toml:"image"`        // The backing image for this profile
-	Name        string           `toml:"-"`            // Name of this profile, set by file name not toml
-	RemoveRepos []string         `toml:"remove_repos"` // A set of repos to remove. ["*"] is valid here.
-	Repos       map[string]*Repo `toml:"repo"`         // Allow defining custom repos
+	Inherit     string           `toml:"inherit,omitempty"`      // Name of the profile this one extends
+	AddRepos    []string         `toml:"add_repos,omitempty"`    // Allow locking to a single set of repos
+	Image       string           `toml:"image"`                  // The backing image for this profile
+	Name        string           `toml:"-"`                      // Name of this profile, set by file name not toml
+	RemoveRepos []string         `toml:"remove_repos,omitempty"` // A set of repos to remove. ["*"] is valid here.
+	Repos       map[string]*Repo `toml:"repo,omitempty"`         // Allow defining custom repos
+	Limits      Limits           `toml:"limits"`                 // Override the configured resource limits
+	Pins        map[string]*Pin  `toml:"pin,omitempty"`          // Per-package pins
+
+	Path    string   `toml:"-"` // File the profile was loaded from
+	Parents []string `toml:"-"` // Files of each inherited profile, nearest first
 }
 
 var (
@@ -61,7 +81,9 @@ func NewProfile(name string) (*Profile, error) {
 	return nil, ErrInvalidProfile
 }
 
-// GetAllProfiles will locate all available profiles for solbuild
+// GetAllProfiles will locate all available profiles for solbuild. As with
+// NewProfile, a profile in an earlier system path hides any of the same name
+// in the later paths.
 func GetAllProfiles() (map[string]*Profile, error) {
 	ret := make(map[string]*Profile)
 
@@ -71,6 +93,10 @@ func GetAllProfiles() (map[string]*Profile, error) {
 		profiles, _ := filepath.Glob(gl)
 
 		for _, o := range profiles {
+			name := strings.TrimSuffix(filepath.Base(o), ProfileSuffix)
+			if _, ok := ret[name]; ok {
+				continue
+			}
 			if profile, err := NewProfileFromPath(o); err == nil {
 				ret[profile.Name] = profile
 			} else {
@@ -81,12 +107,78 @@ func GetAllProfiles() (map[string]*Profile, error) {
 	return ret, nil
 }
 
-// NewProfileFromPath will attempt to load a profile from the given file name
+// NewProfileFromPath will attempt to load a profile from the given file name.
+// If the profile inherits another, the parent is loaded first and then
+// overridden by this profile.
 func NewProfileFromPath(path string) (*Profile, error) {
+	return loadProfile(path, make(map[string]bool))
+}
+
+// findParentProfile will locate the named parent of the profile at path. The
+// system paths are searched first, and then the directory of the profile. A
+// profile may inherit one of the same name, i.e. to extend a profile in
+// /usr/share from /etc, so it never finds itself.
+func findParentProfile(name, path string) (string, error) {
+	dirs := append([]string{}, ConfigPaths...)
+	dirs = append(dirs, filepath.Dir(path))
+	for _, dir := range dirs {
+		fp, err := filepath.Abs(filepath.Join(dir, name+ProfileSuffix))
+		if err != nil {
+			return "", err
+		}
+		if fp != path && PathExists(fp) {
+			return fp, nil
+		}
+	}
+	return "", fmt.Errorf("Cannot inherit unknown profile %v", name)
+}
+
+// inheritFrom will fill in anything this profile doesn't set from the parent
+func (p *Profile) inheritFrom(parent *Profile) {
+	if p.Image == "" {
+		p.Image = parent.Image
+	}
+	if p.AddRepos == nil {
+		p.AddRepos = parent.AddRepos
+	}
+	if p.RemoveRepos == nil {
+		p.RemoveRepos = parent.RemoveRepos
+	}
+	repos := make(map[string]*Repo)
+	for name, repo := range parent.Repos {
+		repos[name] = repo
+	}
+	for name, repo := range p.Repos {
+		repos[name] = repo
+	}
+	p.Repos = repos
+	pins := make(map[string]*Pin)
+	for name, pin := range parent.Pins {
+		pins[name] = pin
+	}
+	for name, pin := range p.Pins {
+		pins[name] = pin
+	}
+	p.Pins = pins
+	p.Limits = parent.Limits.Merge(p.Limits)
+	p.Parents = append([]string{parent.Path}, parent.Parents...)
+}
+
+// loadProfile will load the profile at path along with any it inherits,
+// using seen to detect cycles.
+func loadProfile(path string, seen map[string]bool) (*Profile, error) {
 	basename := filepath.Base(path)
 	if !strings.HasSuffix(basename, ProfileSuffix) {
 		return nil, fmt.Errorf("Not a .profile file: %v", path)
 	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[path] {
+		return nil, fmt.Errorf("Profile inheritance cycle at %v", path)
+	}
+	seen[path] = true
 
 	fi, err := os.Open(path)
 	if err != nil {
@@ -97,20 +189,59 @@ func NewProfileFromPath(path string) (*Profile, error) {
 	profileName := basename[:len(basename)-len(ProfileSuffix)]
 
 	var b []byte
-	profile := &Profile{Name: profileName}
+	profile := &Profile{Name: profileName, Path: path}
 
 	// Read the config file
 	if b, err = ioutil.ReadAll(fi); err != nil {
 		return nil, err
 	}
 
-	if _, err = toml.Decode(string(b), profile); err != nil {
+	if _, err = decodeConfigFile(path, b, profile); err != nil {
 		return nil, err
 	}
 
+	// Check the repos defined here before any are inherited
+	for name, repo := range profile.Repos {
+		repo.path = path
+		key := toml.Key{"repo", name, "uri"}
+		if repo.URI == "" {
+			return nil, newConfigError(path, b, toml.Key{"repo", name}, "Repo %v has no uri", name)
+		}
+		if repo.Local {
+			continue
+		}
+		if err = validateRemoteURI(repo.URI); err != nil {
+			return nil, newConfigError(path, b, key, "Invalid uri for remote repo %v: %v", name, err)
+		}
+	}
+
+	if profile.Inherit != "" {
+		parentPath, err := findParentProfile(profile.Inherit, path)
+		if err != nil {
+			return nil, err
+		}
+		parent, err := loadProfile(parentPath, seen)
+		if err != nil {
+			return nil, err
+		}
+		profile.inheritFrom(parent)
+	}
+
 	// Ensure all repos have a valid name
 	for name, repo := range profile.Repos {
 		repo.Name = name
+		// Only the index of a local repo is available to sign or verify
+		if !repo.Local && (repo.SigningKey != "" || repo.VerifyKeyring != "") {
+			return nil, fmt.Errorf("Cannot sign or verify non-local repo %v", name)
+		}
+	}
+
+	// A pin must actually pin something
+	for name, pin := range profile.Pins {
+		pin.Name = name
+		if pin.Repo == "" && pin.Release < 1 {
+			return nil, fmt.Errorf("Pin for %v needs a repo or release", name)
+		}
 	}
 
 	// Ignore a wildcard add
@@ -127,3 +258,28 @@ func NewProfileFromPath(path string) (*Profile, error) {
 
 	return profile, nil
 }
+
+// ReposToAdd will return the repos the profile adds to the build root, with
+// the highest priority first. Repos of equal priority keep the order given in
+// add_repos, or are sorted by name when every repo is added.
+func (p *Profile) ReposToAdd() []*Repo {
+	var repos []*Repo
+	if (len(p.AddRepos) == 1 && p.AddRepos[0] == "*") || len(p.AddRepos) == 0 {
+		var names []string
+		for name := range p.Repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			repos = append(repos, p.Repos[name])
+		}
+	} else {
+		for _, name := range p.AddRepos {
+			repos = append(repos, p.Repos[name])
+		}
+	}
+	sort.SliceStable(repos, func(i, j int) bool {
+		return repos[i].Priority > repos[j].Priority
+	})
+	return repos
+}
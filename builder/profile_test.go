@@ -17,6 +17,7 @@
 package builder
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -62,3 +63,75 @@ func TestLoadProfile(t *testing.T) {
 		t.Fatalf("Invalid AddRepos: %s", profile.AddRepos[0])
 	}
 }
+
+func TestReposToAdd(t *testing.T) {
+	profile := &Profile{
+		Name: "priority",
+		Repos: map[string]*Repo{
+			"Solus":   {Name: "Solus"},
+			"Local":   {Name: "Local", Local: true, Priority: 10},
+			"Staging": {Name: "Staging", Priority: 5},
+			"Extra":   {Name: "Extra"},
+		},
+	}
+	var names []string
+	for _, repo := range profile.ReposToAdd() {
+		names = append(names, repo.Name)
+	}
+	if strings.Join(names, ",") != "Local,Staging,Extra,Solus" {
+		t.Fatalf("Repos should be ordered by priority, then name: %v", names)
+	}
+	profile.AddRepos = []string{"Solus", "Extra", "Local"}
+	names = nil
+	for _, repo := range profile.ReposToAdd() {
+		names = append(names, repo.Name)
+	}
+	if strings.Join(names, ",") != "Local,Solus,Extra" {
+		t.Fatalf("Repos should be ordered by priority, then add_repos: %v", names)
+	}
+}
+
+func TestInheritProfile(t *testing.T) {
+	profile, err := NewProfileFromPath("testdata/child.profile")
+	if err != nil {
+		t.Fatalf("Failed to load inheriting profile: %v", err)
+	}
+	if profile.Image != "unstable-x86_64" {
+		t.Fatalf("Image should be inherited, got: %v", profile.Image)
+	}
+	if len(profile.Repos) != 3 || profile.Repos["Solus"] == nil {
+		t.Fatalf("Repos should be inherited: %v", profile.Repos)
+	}
+	if repo := profile.Repos["Local"]; repo.URI != "/var/lib/child" || repo.Priority != 10 {
+		t.Fatalf("Repo should be overridden: %+v", repo)
+	}
+	if len(profile.AddRepos) != 1 || profile.AddRepos[0] != "*" {
+		t.Fatalf("add_repos should be overridden: %v", profile.AddRepos)
+	}
+	if len(profile.Parents) != 1 || !strings.HasSuffix(profile.Parents[0], ProfileTestFile) {
+		t.Fatalf("Invalid parents: %v", profile.Parents)
+	}
+	if _, err = NewProfileFromPath("testdata/cycle-a.profile"); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("Should detect the inheritance cycle, got: %v", err)
+	}
+}
+
+func TestGetAllProfiles(t *testing.T) {
+	defer withConfigPaths(t,
+		map[string]string{"unstable.profile": "image = \"unstable-x86_64\"\n"},
+		map[string]string{
+			"unstable.profile": "image = \"main-x86_64\"\n",
+			"main.profile":     "image = \"main-x86_64\"\n",
+		},
+	)()
+	profiles, err := GetAllProfiles()
+	if err != nil {
+		t.Fatalf("Failed to load profiles: %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("Expected 2 profiles, got %d", len(profiles))
+	}
+	if profiles["unstable"].Image != "unstable-x86_64" {
+		t.Fatalf("The first config path should take priority, got %v", profiles["unstable"].Path)
+	}
+}
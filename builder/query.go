@@ -0,0 +1,453 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"github.com/getsolus/libosdev/disk"
+	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// FilesFile is the file within each eopkg listing the files it installs
+	FilesFile = "files.xml"
+)
+
+// A QueryKind is the type of provider being searched for
+type QueryKind string
+
+const (
+	// QueryName matches the name or summary of a package
+	QueryName QueryKind = "name"
+
+	// QueryPackage matches the exact name of a package
+	QueryPackage QueryKind = "package"
+
+	// QueryPkgConfig matches a pkgconfig() provider
+	QueryPkgConfig QueryKind = "pkgconfig"
+
+	// QueryPkgConfig32 matches a pkgconfig32() provider
+	QueryPkgConfig32 QueryKind = "pkgconfig32"
+
+	// QueryLibrary matches a shared library within a library directory
+	QueryLibrary QueryKind = "library"
+
+	// QueryBinary matches an executable within a bin directory
+	QueryBinary QueryKind = "binary"
+
+	// QueryFile matches an absolute file path
+	QueryFile QueryKind = "file"
+)
+
+var (
+	// libraryDirs are the directories searched for a QueryLibrary
+	libraryDirs = []string{"usr/lib64", "usr/lib32", "usr/lib", "lib64", "lib32", "lib"}
+
+	// binaryDirs are the directories searched for a QueryBinary
+	binaryDirs = []string{"usr/bin", "usr/sbin", "bin", "sbin"}
+)
+
+// A Query is a search for packages within the repository indexes
+type Query struct {
+	Kind QueryKind
+	Term string
+}
+
+// ParseQuery will determine what is being asked for, in the same form used
+// for build dependencies, i.e. pkgconfig(zlib), pkgconfig32(zlib), libz.so.1,
+// cmake or /usr/bin/cmake.
+func ParseQuery(term string) *Query {
+	term = strings.TrimSpace(term)
+	for _, kind := range []QueryKind{QueryPkgConfig, QueryPkgConfig32} {
+		prefix := string(kind) + "("
+		if strings.HasPrefix(term, prefix) && strings.HasSuffix(term, ")") {
+			return &Query{Kind: kind, Term: term[len(prefix) : len(term)-1]}
+		}
+	}
+	switch {
+	case strings.HasPrefix(term, "/"):
+		return &Query{Kind: QueryFile, Term: path.Clean(term)}
+	case strings.Contains(term, ".so"):
+		return &Query{Kind: QueryLibrary, Term: term}
+	default:
+		return &Query{Kind: QueryBinary, Term: term}
+	}
+}
+
+// String will return the query in the form accepted by ParseQuery
+func (q *Query) String() string {
+	switch q.Kind {
+	case QueryPkgConfig, QueryPkgConfig32:
+		return fmt.Sprintf("%s(%s)", q.Kind, q.Term)
+	default:
+		return q.Term
+	}
+}
+
+// needsFiles will determine whether the query can only be answered by the
+// files of each package, rather than the index alone.
+func (q *Query) needsFiles() bool {
+	switch q.Kind {
+	case QueryLibrary, QueryBinary, QueryFile:
+		return true
+	default:
+		return false
+	}
+}
+
+// matchFile will determine whether the path, relative to /, satisfies the query
+func (q *Query) matchFile(p string) bool {
+	switch q.Kind {
+	case QueryFile:
+		return "/"+p == q.Term
+	case QueryLibrary:
+		return matchInDirs(p, q.Term, libraryDirs)
+	case QueryBinary:
+		return matchInDirs(p, q.Term, binaryDirs)
+	default:
+		return false
+	}
+}
+
+// matchInDirs will determine whether p is the named file within one of dirs
+func matchInDirs(p, name string, dirs []string) bool {
+	dir, base := path.Split(p)
+	if base != name {
+		return false
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	for _, d := range dirs {
+		if dir == d {
+			return true
+		}
+	}
+	return false
+}
+
+// A QueryResult is a package satisfying a query
+type QueryResult struct {
+	Package string // Name of the package
+	Version string // Upstream version
+	Release int    // Package release number
+	Repo    string // Repository listing the package
+	Summary string // Summary of the package
+	Match   string // What satisfied the query, such as the file path
+	URI     string // Location of the package relative to the index
+}
+
+// queryPackage is the subset of each package in the index used for queries
+type queryPackage struct {
+	Name    string `xml:"Name"`
+	Summary []struct {
+		Lang string `xml:"lang,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"Summary"`
+	Updates []struct {
+		Release int    `xml:"release,attr"`
+		Version string `xml:"Version"`
+	} `xml:"History>Update"`
+	PkgConfig   []string `xml:"Provides>PkgConfig"`
+	PkgConfig32 []string `xml:"Provides>PkgConfig32"`
+	PackageURI  string   `xml:"PackageURI"`
+}
+
+// summary will return the english summary of the package
+func (p *queryPackage) summary() string {
+	for _, s := range p.Summary {
+		if s.Lang == "" || s.Lang == "en" {
+			return strings.TrimSpace(s.Text)
+		}
+	}
+	if len(p.Summary) > 0 {
+		return strings.TrimSpace(p.Summary[0].Text)
+	}
+	return ""
+}
+
+// result will return the QueryResult for the package
+func (p *queryPackage) result(repo, match string) *QueryResult {
+	r := &QueryResult{
+		Package: p.Name,
+		Repo:    repo,
+		Summary: p.summary(),
+		Match:   match,
+		URI:     p.PackageURI,
+	}
+	// The newest update is always first in the history
+	if len(p.Updates) > 0 {
+		r.Version = p.Updates[0].Version
+		r.Release = p.Updates[0].Release
+	}
+	return r
+}
+
+// queryFiles is files.xml, listing the files installed by a package
+type queryFiles struct {
+	Paths []string `xml:"File>Path"`
+}
+
+// A QuerySource is a repository index available on the host. The files of
+// each package are read from the packages of a local repo, or from the
+// metadata of packages installed in the backing image.
+type QuerySource struct {
+	Repo      string // Name of the repository
+	Index     string // Path to the index
+	Packages  string // Directory holding the packages of a local repo
+	Installed string // Directory holding the metadata of installed packages
+
+	pkgs []*queryPackage // Packages within the index, once read
+}
+
+// readIndex will read the index, decompressing it if needed. The index is
+// only read once, as the source may be queried many times.
+func (s *QuerySource) readIndex() ([]*queryPackage, error) {
+	if s.pkgs != nil {
+		return s.pkgs, nil
+	}
+	f, err := os.Open(s.Index)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(s.Index, ".xz") {
+		if r, err = xz.NewReader(f); err != nil {
+			return nil, err
+		}
+	}
+	var index struct {
+		Packages []*queryPackage `xml:"Package"`
+	}
+	if err = xml.NewDecoder(r).Decode(&index); err != nil {
+		return nil, err
+	}
+	s.pkgs = index.Packages
+	if s.pkgs == nil {
+		s.pkgs = []*queryPackage{}
+	}
+	return s.pkgs, nil
+}
+
+// readFiles will return the files of the package, or nil if they are not
+// available on the host.
+func (s *QuerySource) readFiles(p *queryPackage) ([]string, error) {
+	var b []byte
+	switch {
+	case s.Packages != "" && p.PackageURI != "":
+		zr, err := zip.OpenReader(filepath.Join(s.Packages, p.PackageURI))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.Name != FilesFile {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			b, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	case s.Installed != "" && len(p.Updates) > 0:
+		dir := fmt.Sprintf("%s-%s-%d", p.Name, p.Updates[0].Version, p.Updates[0].Release)
+		var err error
+		if b, err = ioutil.ReadFile(filepath.Join(s.Installed, dir, FilesFile)); err != nil {
+			if os.IsNotExist(err) {
+				// Not installed in the image
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	if b == nil {
+		return nil, nil
+	}
+	var files queryFiles
+	if err := xml.Unmarshal(b, &files); err != nil {
+		return nil, err
+	}
+	return files.Paths, nil
+}
+
+// Query will return every package in the index satisfying the query
+func (s *QuerySource) Query(q *Query) ([]*QueryResult, error) {
+	pkgs, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var results []*QueryResult
+	term := strings.ToLower(q.Term)
+	for _, p := range pkgs {
+		switch q.Kind {
+		case QueryName:
+			if strings.Contains(strings.ToLower(p.Name), term) || strings.Contains(strings.ToLower(p.summary()), term) {
+				results = append(results, p.result(s.Repo, p.Name))
+			}
+		case QueryPackage:
+			if p.Name == q.Term {
+				results = append(results, p.result(s.Repo, p.Name))
+			}
+		case QueryPkgConfig, QueryPkgConfig32:
+			provides := p.PkgConfig
+			if q.Kind == QueryPkgConfig32 {
+				provides = p.PkgConfig32
+			}
+			for _, name := range provides {
+				if name == q.Term {
+					results = append(results, p.result(s.Repo, q.String()))
+					break
+				}
+			}
+		default:
+			files, err := s.readFiles(p)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"package": p.Name,
+					"repo":    s.Repo,
+					"error":   err,
+				}).Warning("Failed to read package files")
+				continue
+			}
+			for _, f := range files {
+				if q.matchFile(f) {
+					results = append(results, p.result(s.Repo, "/"+f))
+					break
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// mountReadOnly will mount the backing image read-only at the given directory,
+// so that the indexes cached within it can be read on the host. The directory
+// should be private to the caller, as the image root is shared with updates.
+// The caller is responsible for unmounting it.
+func (b *BackingImage) mountReadOnly(dir string) error {
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return err
+	}
+	if err := disk.GetMountManager().Mount(b.ImagePath, dir, "auto", "ro", "loop"); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.ImagePath,
+			"error": err,
+		}).Error("Failed to mount rootfs")
+		return err
+	}
+	return nil
+}
+
+// findIndex will return the index within the directory, preferring the
+// uncompressed one, or an empty string if it has none.
+func findIndex(dir string) string {
+	for _, name := range []string{IndexFile, IndexXZFile} {
+		if p := filepath.Join(dir, name); PathExists(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// QuerySources will return the repository indexes the profile would use for
+// a build, that are available on the host. The repos of the image are read
+// from root, where the backing image has been mounted, unless the profile
+// removes them.
+func (p *Profile) QuerySources(root string) []*QuerySource {
+	var sources []*QuerySource
+	removeAll := len(p.RemoveRepos) == 1 && p.RemoveRepos[0] == "*"
+	removed := make(map[string]bool)
+	for _, name := range p.RemoveRepos {
+		removed[name] = true
+	}
+
+	if root != "" && !removeAll {
+		dirs, _ := filepath.Glob(filepath.Join(root, "var", "lib", "eopkg", "index", "*"))
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			name := filepath.Base(dir)
+			index := findIndex(dir)
+			if removed[name] || index == "" {
+				continue
+			}
+			sources = append(sources, &QuerySource{
+				Repo:      name,
+				Index:     index,
+				Installed: filepath.Join(root, "var", "lib", "eopkg", "package"),
+			})
+		}
+	}
+
+	for _, repo := range p.ReposToAdd() {
+		name := repo.Name
+		if !repo.Local {
+			log.WithFields(log.Fields{
+				"repo": name,
+			}).Debug("Skipping remote repository, its index is not on the host")
+			continue
+		}
+		index := findIndex(repo.URI)
+		if index == "" {
+			log.WithFields(log.Fields{
+				"repo": name,
+			}).Warning("Repository index doesn't exist. Please index it to use it")
+			continue
+		}
+		sources = append(sources, &QuerySource{
+			Repo:     name,
+			Index:    index,
+			Packages: repo.URI,
+		})
+	}
+	return sources
+}
+
+// RunQuery will answer the query from every source, sorted by package name
+func RunQuery(sources []*QuerySource, q *Query) ([]*QueryResult, error) {
+	var results []*QueryResult
+	for _, s := range sources {
+		r, err := s.Query(q)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"repo":  s.Repo,
+				"index": s.Index,
+				"error": err,
+			}).Error("Failed to read repository index")
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Package < results[j].Package
+	})
+	return results, nil
+}
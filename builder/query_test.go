@@ -0,0 +1,141 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testFiles = `<Files>
+    <File>
+        <Path>usr/bin/nano</Path>
+        <Type>executable</Type>
+    </File>
+</Files>
+`
+
+func TestParseQuery(t *testing.T) {
+	for term, want := range map[string]Query{
+		"pkgconfig(zlib)":   {Kind: QueryPkgConfig, Term: "zlib"},
+		"pkgconfig32(zlib)": {Kind: QueryPkgConfig32, Term: "zlib"},
+		"libz.so.1":         {Kind: QueryLibrary, Term: "libz.so.1"},
+		"/usr/bin//cmake":   {Kind: QueryFile, Term: "/usr/bin/cmake"},
+		"cmake":             {Kind: QueryBinary, Term: "cmake"},
+	} {
+		if q := ParseQuery(term); *q != want {
+			t.Fatalf("Parsed %s as %+v, expected %+v", term, *q, want)
+		}
+	}
+}
+
+// writeQueryRepo will create an indexed local repo holding nano
+func writeQueryRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "solbuild-query")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "nano-5.4-120-1-x86_64.eopkg"))
+	if err != nil {
+		t.Fatalf("Failed to create eopkg: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create(MetadataFile)
+	fmt.Fprintf(w, testMetadata, 120)
+	w, _ = zw.Create(FilesFile)
+	fmt.Fprint(w, testFiles)
+	zw.Close()
+	f.Close()
+
+	if err = IndexDir(context.Background(), dir, ""); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+	return dir
+}
+
+func TestQuerySource(t *testing.T) {
+	dir := writeQueryRepo(t)
+	defer os.RemoveAll(dir)
+	profile := &Profile{
+		Name:  "local",
+		Repos: map[string]*Repo{"Local": {Name: "Local", URI: dir, Local: true}},
+	}
+	sources := profile.QuerySources("")
+	if len(sources) != 1 {
+		t.Fatalf("Expected the local repo as the only source, got %d", len(sources))
+	}
+
+	for term, found := range map[string]bool{
+		"nano":          true,
+		"/usr/bin/nano": true,
+		"/usr/bin/vim":  false,
+		"libnano.so.1":  false,
+	} {
+		results, err := RunQuery(sources, ParseQuery(term))
+		if err != nil {
+			t.Fatalf("Failed to query %s: %v", term, err)
+		}
+		if found != (len(results) == 1) {
+			t.Fatalf("Unexpected results for %s: %v", term, results)
+		}
+	}
+
+	results, err := RunQuery(sources, &Query{Kind: QueryName, Term: "EDITOR"})
+	if err != nil || len(results) != 1 || results[0].Release != 120 || results[0].Summary != "Small editor" {
+		t.Fatalf("Search should match the summary, got %v", results)
+	}
+}
+
+func TestResolveDeps(t *testing.T) {
+	dir := writeQueryRepo(t)
+	defer os.RemoveAll(dir)
+	sources := []*QuerySource{{Repo: "Local", Index: filepath.Join(dir, IndexFile), Packages: dir}}
+
+	unresolved, err := ResolveDeps(sources, []string{"nano", "nano-devel", "pkgconfig(nano)"})
+	if err != nil {
+		t.Fatalf("Failed to resolve deps: %v", err)
+	}
+	if len(unresolved) != 2 {
+		t.Fatalf("Expected 2 unresolved deps, got %d", len(unresolved))
+	}
+	if u := unresolved[0]; u.Dep != "nano-devel" || len(u.Suggestions) != 1 || u.Suggestions[0] != "nano" {
+		t.Fatalf("Should suggest nano for nano-devel, got %+v", u)
+	}
+}
+
+func TestDepsCertain(t *testing.T) {
+	if !(&Profile{}).depsCertain() {
+		t.Fatalf("Misses against the image index should be certain")
+	}
+	p := &Profile{Repos: map[string]*Repo{"Local": {Name: "Local", URI: "/repo", Local: true}}}
+	if !p.depsCertain() {
+		t.Fatalf("Misses should be certain with only local repos")
+	}
+	p.Repos["Remote"] = &Repo{Name: "Remote", URI: "https://example.com/eopkg-index.xml.xz"}
+	if p.depsCertain() {
+		t.Fatalf("Misses should not be certain with remote repos")
+	}
+	p.AddRepos = []string{"Local"}
+	if !p.depsCertain() {
+		t.Fatalf("Remote repos that aren't added should not matter")
+	}
+}
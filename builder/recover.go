@@ -0,0 +1,157 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"strings"
+)
+
+// A recoverRoot is a workspace that may have been left behind by a previous
+// solbuild process that never got to clean up.
+type recoverRoot struct {
+	dir       string       // Base directory of the workspace
+	deathPath string       // Where processes within the workspace are rooted
+	lockPath  string       // Lockfile protecting the workspace
+	mounts    []*MountInfo // Mounts found within the workspace
+}
+
+// findRecoverRoot will determine which workspace owns the given mountpoint,
+// returning nil if it isn't within one.
+func findRecoverRoot(config *Config, point string) *recoverRoot {
+	// Overlays live at OverlayRootDir/profile/package
+	if rel, err := filepath.Rel(config.OverlayRootDir, point); err == nil && !strings.HasPrefix(rel, "..") {
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) >= 2 && rel != "." {
+			dir := filepath.Join(config.OverlayRootDir, parts[0], parts[1])
+			return &recoverRoot{
+				dir:       dir,
+				deathPath: filepath.Join(dir, "union"),
+				lockPath:  fmt.Sprintf("%s.lock", dir),
+			}
+		}
+	}
+	// Image updates happen within ImageRootsDir/name
+	if rel, err := filepath.Rel(ImageRootsDir, point); err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+		name := strings.Split(rel, string(filepath.Separator))[0]
+		return &recoverRoot{
+			dir:       filepath.Join(ImageRootsDir, name),
+			deathPath: filepath.Join(ImageRootsDir, name),
+			lockPath:  filepath.Join(ImagesDir, name+".lock"),
+		}
+	}
+	return nil
+}
+
+// Recover will clean up after solbuild processes that were killed before
+// they could tear down their build roots. Processes still running within
+// those roots are killed, leftover mounts are removed deepest first and any
+// dead lockfiles are deleted. Workspaces held by a running solbuild are left
+// untouched.
+func Recover(config *Config) error {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return err
+	}
+
+	// Find every mount in a workspace, grouped by workspace
+	roots := make(map[string]*recoverRoot)
+	var order []string
+	for _, dir := range []string{config.OverlayRootDir, ImageRootsDir} {
+		for _, m := range MountsUnder(mounts, dir) {
+			root := findRecoverRoot(config, m.MountPoint)
+			if root == nil {
+				continue
+			}
+			if existing, ok := roots[root.dir]; ok {
+				root = existing
+			} else {
+				roots[root.dir] = root
+				order = append(order, root.dir)
+			}
+			root.mounts = append(root.mounts, m)
+		}
+	}
+
+	var failed []string
+	for _, dir := range order {
+		root := roots[dir]
+		if PathExists(root.lockPath) {
+			status, err := NewLockStatus(root.lockPath)
+			if err == nil && status.Active {
+				log.WithFields(log.Fields{
+					"dir":  root.dir,
+					"lock": root.lockPath,
+				}).Info("Skipping workspace in use by another process")
+				continue
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"dir":    root.dir,
+			"mounts": len(root.mounts),
+		}).Info("Recovering workspace")
+
+		// Nothing may keep the mounts busy
+		for i := 0; i < 10; i++ {
+			MurderDeathKill(root.deathPath)
+		}
+
+		for _, m := range root.mounts {
+			log.WithFields(log.Fields{
+				"point": m.MountPoint,
+				"type":  m.FSType,
+			}).Debug("Unmounting leftover mount")
+			if err := UnmountPath(m.MountPoint); err != nil {
+				log.WithFields(log.Fields{
+					"point": m.MountPoint,
+					"error": err,
+				}).Error("Failed to unmount leftover mount")
+				failed = append(failed, m.MountPoint)
+			}
+		}
+	}
+
+	// Now remove any lockfile whose owner has gone away
+	locks, err := GetAllLocks(config)
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if l.Active {
+			continue
+		}
+		if err := l.Clear(); err != nil {
+			log.WithFields(log.Fields{
+				"lock":  l.Path,
+				"error": err,
+			}).Error("Failed to remove dead lockfile")
+			failed = append(failed, l.Path)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"lock": l.Path,
+		}).Info("Removed dead lockfile")
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to recover: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
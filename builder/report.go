@@ -0,0 +1,209 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// ReportSuffix is appended to the package name, version and release to
+	// form the name of the build report.
+	ReportSuffix = ".report.json"
+
+	// ReportStatusSuccess is the status of a build that completed successfully
+	ReportStatusSuccess = "success"
+
+	// ReportStatusFailed is the status of a build that failed
+	ReportStatusFailed = "failed"
+
+	// ReportStatusInterrupted is the status of a build that was cancelled
+	ReportStatusInterrupted = "interrupted"
+
+	// ReportStatusTimedOut is the status of a build that exceeded its time limit
+	ReportStatusTimedOut = "timed-out"
+)
+
+// ReportImage describes the backing image used for a build
+type ReportImage struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Modified time.Time `json:"modified"`
+}
+
+// ReportSource describes a source used for a build
+type ReportSource struct {
+	URI      string `json:"uri"`
+	Resolved string `json:"resolved,omitempty"` // Checksum or git commit
+}
+
+// ReportPhase records how a single Phase of the build went
+type ReportPhase struct {
+	Name     Phase   `json:"name"`
+	Duration float64 `json:"duration"` // Seconds
+	Error    string  `json:"error,omitempty"`
+}
+
+// ReportFile is a file produced by the build
+type ReportFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReportPackager is the identity the package was built as
+type ReportPackager struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// A BuildReport is a machine readable summary of a build, written alongside
+// the collected build artifacts for archival by CI.
+type BuildReport struct {
+	Package  string         `json:"package"`
+	Version  string         `json:"version"`
+	Release  int            `json:"release"`
+	Type     PackageType    `json:"type"`
+	Profile  string         `json:"profile"`
+	Image    ReportImage    `json:"image"`
+	Repos    []string       `json:"repos"`
+	Sources  []ReportSource `json:"sources"`
+	Phases   []ReportPhase  `json:"phases"`
+	Files    []ReportFile   `json:"files"`
+	Packager ReportPackager `json:"packager"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Duration float64        `json:"duration"` // Seconds
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+
+	pkg *Package // Package being built, to resolve sources when done
+}
+
+// NewBuildReport will create a new report for the build of the package
+func NewBuildReport(pkg *Package, profile *Profile, image *BackingImage) *BuildReport {
+	r := &BuildReport{
+		Package: pkg.Name,
+		Version: pkg.Version,
+		Release: pkg.Release,
+		Type:    pkg.Type,
+		Profile: profile.Name,
+		Image: ReportImage{
+			Name: image.Name,
+			Path: image.ImagePath,
+		},
+		Repos:   []string{},
+		Sources: []ReportSource{},
+		Phases:  []ReportPhase{},
+		Files:   []ReportFile{},
+		pkg:     pkg,
+	}
+	if st, err := os.Stat(image.ImagePath); err == nil {
+		r.Image.Modified = st.ModTime().UTC()
+	}
+	usr := GetUserInfo()
+	r.Packager = ReportPackager{Name: usr.Name, Email: usr.Email}
+	return r
+}
+
+// Notify will record the event within the report
+func (r *BuildReport) Notify(e *Event) {
+	switch e.Kind {
+	case EventBuildStarted:
+		r.Started = e.Time.UTC()
+	case EventPhaseFinished:
+		phase := ReportPhase{
+			Name:     e.Phase,
+			Duration: e.Duration.Seconds(),
+		}
+		if e.Error != nil {
+			phase.Error = e.Error.Error()
+		}
+		r.Phases = append(r.Phases, phase)
+		switch data := e.Data.(type) {
+		case *ReposData:
+			if data != nil {
+				r.Repos = append(r.Repos, data.Added...)
+			}
+		case *ArtifactsData:
+			if data != nil {
+				r.addFiles(data.Files)
+			}
+		}
+	case EventBuildFinished:
+		r.Finished = e.Time.UTC()
+		r.Duration = e.Duration.Seconds()
+		r.Status = ReportStatusSuccess
+		if e.Error != nil {
+			r.Error = e.Error.Error()
+			switch e.Error {
+			case ErrInterrupted:
+				r.Status = ReportStatusInterrupted
+			case ErrTimedOut:
+				r.Status = ReportStatusTimedOut
+			default:
+				r.Status = ReportStatusFailed
+			}
+		}
+		for _, s := range r.pkg.Sources {
+			r.Sources = append(r.Sources, ReportSource{
+				URI:      s.GetIdentifier(),
+				Resolved: s.Resolved(),
+			})
+		}
+	}
+}
+
+// addFiles will record the name, size and checksum of each produced file
+func (r *BuildReport) addFiles(paths []string) {
+	for _, path := range paths {
+		f := ReportFile{Name: filepath.Base(path)}
+		if st, err := os.Stat(path); err == nil {
+			f.Size = st.Size()
+		}
+		if sum, err := FileSha256sum(path); err == nil {
+			f.SHA256 = sum
+		}
+		r.Files = append(r.Files, f)
+	}
+}
+
+// FileName will return the name the report should be written as
+func (r *BuildReport) FileName() string {
+	return fmt.Sprintf("%s-%s-%d%s", r.Package, r.Version, r.Release, ReportSuffix)
+}
+
+// Write will write the report into the given directory, owned by the user
+func (r *BuildReport) Write(dir string, usr *UserInfo) (string, error) {
+	b, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, r.FileName())
+	if err = ioutil.WriteFile(path, append(b, '\n'), 00644); err != nil {
+		return "", err
+	}
+	if err = os.Chown(path, usr.UID, usr.GID); err != nil {
+		return path, err
+	}
+	return path, nil
+}
@@ -0,0 +1,73 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-report")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	artifact := filepath.Join(dir, "nano-5.4-120-1-x86_64.eopkg")
+	if err = ioutil.WriteFile(artifact, []byte("eopkg"), 00644); err != nil {
+		t.Fatalf("Failed to write artifact: %v", err)
+	}
+
+	pkg := &Package{Name: "nano", Version: "5.4", Release: 120, Type: PackageTypeYpkg}
+	r := NewBuildReport(pkg, &Profile{Name: "main-x86_64"}, &BackingImage{Name: "main-x86_64"})
+	now := time.Now()
+	r.Notify(&Event{Kind: EventBuildStarted, Time: now})
+	r.Notify(&Event{Kind: EventPhaseFinished, Phase: PhaseConfigureRepos, Duration: time.Second,
+		Data: &ReposData{Added: []string{"Solus"}}})
+	r.Notify(&Event{Kind: EventPhaseFinished, Phase: PhaseCollectAssets,
+		Data: &ArtifactsData{Files: []string{artifact}}})
+	r.Notify(&Event{Kind: EventBuildFinished, Time: now.Add(time.Minute), Duration: time.Minute, Error: ErrTimedOut})
+
+	path, err := r.Write(dir, &UserInfo{UID: os.Getuid(), GID: os.Getgid()})
+	if err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	if filepath.Base(path) != "nano-5.4-120.report.json" {
+		t.Fatalf("Invalid report name: %s", path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var got BuildReport
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+	if got.Status != ReportStatusTimedOut || got.Duration != 60 {
+		t.Fatalf("Invalid report status: %s %v", got.Status, got.Duration)
+	}
+	if len(got.Repos) != 1 || got.Repos[0] != "Solus" || len(got.Phases) != 2 {
+		t.Fatalf("Invalid report phases: %+v %+v", got.Repos, got.Phases)
+	}
+	if len(got.Files) != 1 || got.Files[0].Size != 5 || len(got.Files[0].SHA256) != 64 {
+		t.Fatalf("Invalid report files: %+v", got.Files)
+	}
+}
@@ -17,6 +17,7 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
@@ -29,43 +30,60 @@ const (
 	BindRepoDir = "/hostRepos"
 )
 
-// addLocalRepo will try to add the repo and bind mount it into the target
-func (p *Package) addLocalRepo(notif PidNotifier, o *Overlay, pkgManager *EopkgManager, repo *Repo) error {
+// mountLocalRepo will bind mount the local repo into the target, returning the
+// path to it within the chroot.
+func (p *Package) mountLocalRepo(o *Overlay, repo *Repo) (string, error) {
 	// Ensure the source exists too. Sorta helpful like that.
 	if !PathExists(repo.URI) {
-		return fmt.Errorf("Local repo does not exist")
+		return "", fmt.Errorf("Local repo %v does not exist: %v", repo.Name, repo.URI)
+	}
+
+	chrootDir := filepath.Join(BindRepoDir, repo.Name)
+	tgt := filepath.Join(o.MountPoint, chrootDir[1:])
+
+	// Already available
+	mounted, err := IsMounted(tgt)
+	if err != nil {
+		return "", err
+	}
+	if mounted {
+		return chrootDir, nil
 	}
 
 	mman := disk.GetMountManager()
 
 	// Ensure the target mountpoint actually exists ...
-	tgt := filepath.Join(o.MountPoint, BindRepoDir[1:], repo.Name)
 	if !PathExists(tgt) {
 		if err := os.MkdirAll(tgt, 00755); err != nil {
-			return err
+			return "", err
 		}
 	}
 
 	// BindMount the directory into place
 	if err := mman.BindMount(repo.URI, tgt); err != nil {
+		return "", err
+	}
+	return chrootDir, nil
+}
+
+// addLocalRepo will try to add the repo and bind mount it into the target, at
+// the given position in the repo order. A negative position appends it.
+func (p *Package) addLocalRepo(ctx context.Context, notif PidNotifier, o *Overlay, pkgManager *EopkgManager, repo *Repo, pos int) error {
+	chrootDir, err := p.mountLocalRepo(o, repo)
+	if err != nil {
 		return err
 	}
-	o.ExtraMounts = append(o.ExtraMounts, tgt)
 
 	// Attempt to autoindex the repo
 	if repo.AutoIndex {
 		log.WithFields(log.Fields{
 			"name": repo.Name,
 		}).Debug("Reindexing repository")
-
-		command := fmt.Sprintf("cd %s/%s; %s", BindRepoDir, repo.Name, eopkgCommand("eopkg index --skip-signing ."))
-		err := ChrootExec(notif, o.MountPoint, command)
-		notif.SetActivePID(0)
-		if err != nil {
+		if err := IndexRepo(ctx, repo.URI, repo.SigningKey); err != nil {
 			return err
 		}
 	} else {
-		tgtIndex := filepath.Join(tgt, "eopkg-index.xml.xz")
+		tgtIndex := filepath.Join(repo.URI, IndexXZFile)
 		if !PathExists(tgtIndex) {
 			log.WithFields(log.Fields{
 				"name": repo.Name,
@@ -73,9 +91,24 @@ func (p *Package) addLocalRepo(notif PidNotifier, o *Overlay, pkgManager *EopkgM
 		}
 	}
 
+	// Refuse to use an index that can't be verified
+	if repo.VerifyKeyring != "" {
+		if err := VerifyIndex(repo.URI, repo.VerifyKeyring); err != nil {
+			log.WithFields(log.Fields{
+				"name":    repo.Name,
+				"keyring": repo.VerifyKeyring,
+				"error":   err,
+			}).Error("Failed to verify repository index")
+			return err
+		}
+		log.WithFields(log.Fields{
+			"name": repo.Name,
+		}).Debug("Verified repository index")
+	}
+
 	// Now add the local repo
-	chrootLocal := filepath.Join(BindRepoDir, repo.Name, "eopkg-index.xml.xz")
-	return pkgManager.AddRepo(repo.Name, chrootLocal)
+	chrootLocal := filepath.Join(chrootDir, IndexXZFile)
+	return pkgManager.AddRepoAt(repo.Name, chrootLocal, pos)
 }
 
 func (p *Package) removeRepos(pkgManager *EopkgManager, repos []string) error {
@@ -97,19 +130,26 @@ func (p *Package) removeRepos(pkgManager *EopkgManager, repos []string) error {
 	return nil
 }
 
-// addRepos will add the specified filtered set of repos to the rootfs
-func (p *Package) addRepos(notif PidNotifier, o *Overlay, pkgManager *EopkgManager, repos []*Repo) error {
+// addRepos will add the specified filtered set of repos to the rootfs. Repos
+// with a positive priority are placed ahead of those already in the image.
+func (p *Package) addRepos(ctx context.Context, notif PidNotifier, o *Overlay, pkgManager *EopkgManager, repos []*Repo) error {
 	if len(repos) < 1 {
 		return nil
 	}
+	next := 0
 	for _, repo := range repos {
+		pos := -1
+		if repo.Priority > 0 {
+			pos = next
+			next++
+		}
 		if repo.Local {
 			log.WithFields(log.Fields{
 				"name": repo.Name,
 				"path": repo.URI,
 			}).Debug("Adding local repo to system")
 
-			if err := p.addLocalRepo(notif, o, pkgManager, repo); err != nil {
+			if err := p.addLocalRepo(ctx, notif, o, pkgManager, repo, pos); err != nil {
 				log.WithFields(log.Fields{
 					"name":  repo.Name,
 					"error": err,
@@ -119,10 +159,11 @@ func (p *Package) addRepos(notif PidNotifier, o *Overlay, pkgManager *EopkgManag
 			continue
 		}
 		log.WithFields(log.Fields{
-			"name": repo.Name,
-			"url":  repo.URI,
+			"name":     repo.Name,
+			"url":      repo.URI,
+			"priority": repo.Priority,
 		}).Debug("Adding repo to system")
-		if err := pkgManager.AddRepo(repo.Name, repo.URI); err != nil {
+		if err := pkgManager.AddRepoAt(repo.Name, repo.URI, pos); err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
 				"name":  repo.Name,
@@ -134,11 +175,19 @@ func (p *Package) addRepos(notif PidNotifier, o *Overlay, pkgManager *EopkgManag
 }
 
 // ConfigureRepos will attempt to configure the repos according to the configuration
-// of the manager.
-func (p *Package) ConfigureRepos(notif PidNotifier, o *Overlay, pkgManager *EopkgManager, profile *Profile) error {
+// of the manager. Cancelling the context will interrupt indexing local repos.
+func (p *Package) ConfigureRepos(ctx context.Context, notif PidNotifier, o *Overlay, pkgManager *EopkgManager, profile *Profile) error {
+	_, err := p.configureRepos(ctx, notif, o, pkgManager, profile)
+	return err
+}
+
+// configureRepos does the real work of ConfigureRepos, returning the changes
+// made for reporting purposes.
+func (p *Package) configureRepos(ctx context.Context, notif PidNotifier, o *Overlay, pkgManager *EopkgManager, profile *Profile) (*ReposData, error) {
+	data := &ReposData{}
 	repos, err := pkgManager.GetRepos()
 	if err != nil {
-		return err
+		return data, err
 	}
 
 	var removals []string
@@ -155,20 +204,19 @@ func (p *Package) ConfigureRepos(notif PidNotifier, o *Overlay, pkgManager *Eopk
 	}
 
 	if err := p.removeRepos(pkgManager, removals); err != nil {
-		return err
+		return data, err
 	}
+	data.Removed = removals
 
-	var addRepos []*Repo
-
-	if (len(profile.AddRepos) == 1 && profile.AddRepos[0] == "*") || len(profile.AddRepos) == 0 {
-		for _, repo := range profile.Repos {
-			addRepos = append(addRepos, repo)
-		}
-	} else {
-		for _, id := range profile.AddRepos {
-			addRepos = append(addRepos, profile.Repos[id])
-		}
+	addRepos := profile.ReposToAdd()
+	if err := p.addRepos(ctx, notif, o, pkgManager, addRepos); err != nil {
+		return data, err
+	}
+	for _, repo := range addRepos {
+		data.Added = append(data.Added, repo.Name)
 	}
 
-	return p.addRepos(notif, o, pkgManager, addRepos)
+	pinned, err := p.applyPins(o, pkgManager, profile)
+	data.Pinned = pinned
+	return data, err
 }
@@ -0,0 +1,352 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// SessionName is the name solbuild is re-executed as to host a Session
+	SessionName = "solbuild-session"
+)
+
+// Operations that may be requested of a Session
+const (
+	SessionBuild  = "build"
+	SessionChroot = "chroot"
+	SessionIndex  = "index"
+	SessionUpdate = "update"
+)
+
+var (
+	// ErrSessionClosed is returned when using a Session after closing it
+	ErrSessionClosed = errors.New("The session has been closed")
+
+	// sessionErrors allows well known errors to survive the trip back from
+	// the session process
+	sessionErrors = map[string]error{
+		"interrupted":   ErrInterrupted,
+		"timed-out":     ErrTimedOut,
+		"lock-timeout":  ErrLockTimeout,
+		"not-installed": ErrProfileNotInstalled,
+		"no-package":    ErrNoPackage,
+		"bad-profile":   ErrInvalidProfile,
+		"bad-image":     ErrInvalidImage,
+	}
+)
+
+func init() {
+	if filepath.Base(os.Args[0]) == SessionName {
+		// Namespaces are per thread, so everything must happen on this one
+		runtime.LockOSThread()
+		os.Exit(sessionMain(os.Args[1:]))
+	}
+}
+
+// A SessionRequest describes a single operation to be carried out by a Session
+type SessionRequest struct {
+	Operation      string        // One of SessionBuild, SessionChroot, etc.
+	Profile        string        // Profile to use, or empty for the default
+	Package        string        // Path to the package file for build & chroot
+	Dir            string        // Directory to index
+	SigningKey     string        // Key to sign the index with, if not the profile's
+	Tmpfs          bool          // Whether to use a tmpfs
+	TmpfsSize      string        // Size bound on the tmpfs
+	ManifestTarget string        // Generate a transit manifest if set
+	OutputDir      string        // Where to store built packages, if not the default
+	Publish        bool          // Whether to publish the built packages to a local repo
+	PublishRepo    string        // Local repo to publish to, empty for the only one
+	SkipDepsCheck  bool          // Whether to skip resolving build dependencies up front
+	BuildTimeout   time.Duration // Overrides the configured build timeout if set
+	LockWait       bool          // Whether to wait for held locks
+	LockTimeout    time.Duration // How long to wait for held locks, implies LockWait
+}
+
+// sessionResponse is the result of a SessionRequest
+type sessionResponse struct {
+	Error string // Error message, if the operation failed
+	Kind  string // Well known error, if any
+}
+
+// A Session carries out any number of operations, one after the other, in a
+// child process that holds a single Manager and namespace for its lifetime.
+// This allows tools to build many packages across profiles without having
+// their own process moved into a new namespace.
+type Session struct {
+	cmd       *exec.Cmd
+	requests  *os.File
+	responses *os.File
+	decoder   *json.Decoder
+	lock      sync.Mutex
+	closed    bool
+}
+
+// NewSession will start a new session process
+func NewSession() (*Session, error) {
+	reqRead, reqWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	respRead, respWrite, err := os.Pipe()
+	if err != nil {
+		reqRead.Close()
+		reqWrite.Close()
+		return nil, err
+	}
+
+	var args []string
+	if log.GetLevel() >= log.DebugLevel {
+		args = append(args, "--debug")
+	}
+	if DisableColors {
+		args = append(args, "--no-color")
+	}
+	c := exec.Command("/proc/self/exe", args...)
+	c.Args[0] = SessionName
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.ExtraFiles = []*os.File{reqRead, respWrite}
+	c.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+
+	err = c.Start()
+	// The child has its own copies now
+	reqRead.Close()
+	respWrite.Close()
+	if err != nil {
+		reqWrite.Close()
+		respRead.Close()
+		return nil, err
+	}
+	return &Session{
+		cmd:       c,
+		requests:  reqWrite,
+		responses: respRead,
+		decoder:   json.NewDecoder(respRead),
+	}, nil
+}
+
+// Run will carry out the request within the session, waiting for it to
+// complete. Cancelling the context will interrupt the operation, leaving the
+// session usable for further requests.
+func (s *Session) Run(ctx context.Context, req *SessionRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+
+	blob, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err = s.requests.Write(append(blob, '\n')); err != nil {
+		return err
+	}
+
+	// Don't return until we're sure no interrupt can follow
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			s.cmd.Process.Signal(syscall.SIGINT)
+		case <-done:
+		}
+	}()
+
+	var resp sessionResponse
+	if err = s.decoder.Decode(&resp); err != nil {
+		return fmt.Errorf("session process failed: %v", err)
+	}
+	if resp.Kind != "" {
+		if known, ok := sessionErrors[resp.Kind]; ok {
+			return known
+		}
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Close will shut down the session process once it has finished
+func (s *Session) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.requests.Close()
+	err := s.cmd.Wait()
+	s.responses.Close()
+	return err
+}
+
+// newSessionResponse will encode the result of an operation
+func newSessionResponse(err error) *sessionResponse {
+	resp := &sessionResponse{}
+	if err == nil {
+		return resp
+	}
+	resp.Error = err.Error()
+	for kind, known := range sessionErrors {
+		if err == known {
+			resp.Kind = kind
+			break
+		}
+	}
+	return resp
+}
+
+// runRequest will carry out a single session request with the manager
+func (m *Manager) runRequest(ctx context.Context, req *SessionRequest) error {
+	if err := m.SetProfile(req.Profile); err != nil {
+		return err
+	}
+	m.SetLockWait(req.LockWait || req.LockTimeout > 0, req.LockTimeout)
+
+	switch req.Operation {
+	case SessionBuild, SessionChroot:
+		pkg, err := NewPackage(req.Package)
+		if err != nil {
+			return err
+		}
+		if err = m.SetPackage(pkg); err != nil {
+			return err
+		}
+		if req.Operation == SessionChroot {
+			return m.Chroot(ctx)
+		}
+		m.SetTmpfs(req.Tmpfs, req.TmpfsSize)
+		m.SetManifestTarget(req.ManifestTarget)
+		m.SetOutputDir(req.OutputDir)
+		m.SetPublish(req.Publish, req.PublishRepo)
+		m.SetSkipDepsCheck(req.SkipDepsCheck)
+		if req.BuildTimeout > 0 {
+			m.SetBuildTimeout(req.BuildTimeout)
+		}
+		return m.Build(ctx)
+	case SessionIndex:
+		m.SetSigningKey(req.SigningKey)
+		return m.Index(ctx, req.Dir)
+	case SessionUpdate:
+		return m.Update(ctx)
+	default:
+		return fmt.Errorf("Unknown session operation: %v", req.Operation)
+	}
+}
+
+// sessionMain is the entry point of the session process. Requests are read
+// from fd 3 and the results written to fd 4, leaving the standard streams
+// free for the operations themselves.
+func sessionMain(args []string) int {
+	for _, arg := range args {
+		switch arg {
+		case "--debug":
+			log.SetLevel(log.DebugLevel)
+		case "--no-color":
+			DisableColors = true
+		}
+	}
+	requests := os.NewFile(3, "requests")
+	responses := os.NewFile(4, "responses")
+
+	manager, err := NewManager()
+	if err != nil {
+		return 1
+	}
+
+	return serveSession(requests, responses, func(ctx context.Context, req *SessionRequest) error {
+		// Builds may drop networking, which must not leak into the next one
+		restore, err := SaveNetworking()
+		if err != nil {
+			return err
+		}
+		err = manager.runRequest(ctx, req)
+		manager.Reset()
+		if err2 := restore(); err2 != nil && err == nil {
+			err = err2
+		}
+		return err
+	})
+}
+
+// sessionSignals are the signals that interrupt the current request
+var sessionSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// serveSession will carry out each request read from requests with run, one
+// after the other, writing each result to responses until requests is closed.
+func serveSession(requests io.Reader, responses io.Writer, run func(context.Context, *SessionRequest) error) int {
+	encoder := json.NewEncoder(responses)
+	decoder := json.NewDecoder(requests)
+
+	// Interrupts are meant for the current request, not us, so they're
+	// dropped whilst we're idle
+	idle := make(chan os.Signal, 1)
+	signal.Notify(idle, sessionSignals...)
+	defer signal.Stop(idle)
+
+	for {
+		var req SessionRequest
+		if err := decoder.Decode(&req); err != nil {
+			// Closed by the parent
+			return 0
+		}
+
+		// Each request gets its own channel, so a late interrupt can't
+		// cancel the next one
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, sessionSignals...)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-sigs:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err := run(ctx, &req)
+		signal.Stop(sigs)
+		cancel()
+
+		if err := encoder.Encode(newSessionResponse(err)); err != nil {
+			return 1
+		}
+	}
+}
@@ -0,0 +1,114 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSessionResponse(t *testing.T) {
+	if resp := newSessionResponse(nil); resp.Error != "" || resp.Kind != "" {
+		t.Fatalf("Success should have an empty response: %+v", resp)
+	}
+	for kind, err := range sessionErrors {
+		resp := newSessionResponse(err)
+		if resp.Kind != kind || sessionErrors[resp.Kind] != err {
+			t.Fatalf("Well known error %v not preserved: %+v", err, resp)
+		}
+	}
+	resp := newSessionResponse(errors.New("oh no"))
+	if resp.Kind != "" || resp.Error != "oh no" {
+		t.Fatalf("Invalid response for unknown error: %+v", resp)
+	}
+}
+
+func TestSessionProtocol(t *testing.T) {
+	reqRead, reqWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	respRead, respWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer respRead.Close()
+
+	// Serve the session from this process, so interrupts are sent to us
+	self, _ := os.FindProcess(os.Getpid())
+	s := &Session{
+		cmd:       &exec.Cmd{Process: self},
+		requests:  reqWrite,
+		responses: respRead,
+		decoder:   json.NewDecoder(respRead),
+	}
+	waiting := make(chan struct{})
+	served := make(chan int)
+	go func() {
+		served <- serveSession(reqRead, respWrite, func(ctx context.Context, req *SessionRequest) error {
+			switch req.Package {
+			case "wait":
+				close(waiting)
+				<-ctx.Done()
+				return ErrInterrupted
+			case "fail":
+				return ErrNoPackage
+			}
+			select {
+			case <-ctx.Done():
+				return errors.New("cancelled by an earlier interrupt")
+			case <-time.After(200 * time.Millisecond):
+				return nil
+			}
+		})
+		respWrite.Close()
+	}()
+
+	if err = s.Run(context.Background(), &SessionRequest{Operation: SessionBuild, Package: "ok"}); err != nil {
+		t.Fatalf("Request should succeed, got: %v", err)
+	}
+	if err = s.Run(context.Background(), &SessionRequest{Operation: SessionBuild, Package: "fail"}); err != ErrNoPackage {
+		t.Fatalf("Well known error should be preserved, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-waiting
+		cancel()
+	}()
+	if err = s.Run(ctx, &SessionRequest{Operation: SessionBuild, Package: "wait"}); err != ErrInterrupted {
+		t.Fatalf("Request should be interrupted, got: %v", err)
+	}
+
+	// An interrupt between requests must not reach the next one
+	self.Signal(syscall.SIGINT)
+	time.Sleep(100 * time.Millisecond)
+	if err = s.Run(context.Background(), &SessionRequest{Operation: SessionBuild, Package: "ok"}); err != nil {
+		t.Fatalf("Request after an interrupt should succeed, got: %v", err)
+	}
+
+	reqWrite.Close()
+	if code := <-served; code != 0 {
+		t.Fatalf("Session should end cleanly once closed, got %d", code)
+	}
+}
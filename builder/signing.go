@@ -0,0 +1,111 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// IndexSignatureSuffix is appended to the name of each index to form the
+	// name of its detached signature.
+	IndexSignatureSuffix = ".sig"
+)
+
+var (
+	// ErrIndexNotSigned is returned when verifying an index with no signature
+	ErrIndexNotSigned = errors.New("The repository index is not signed")
+
+	// signedIndexes are the files that are signed within a repository
+	signedIndexes = []string{IndexFile, IndexXZFile}
+)
+
+// gpgError will include the output of a failed gpg command in the error
+func gpgError(err error, out []byte) error {
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
+}
+
+// SignIndex will create a detached signature for each index in the directory
+// using the given gpg key. If no key is given, any existing signatures are
+// removed as they no longer match the index.
+func SignIndex(dir, key string) error {
+	for _, name := range signedIndexes {
+		path := filepath.Join(dir, name)
+		sig := path + IndexSignatureSuffix
+		if err := os.Remove(sig); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if key == "" {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"file": name,
+			"key":  key,
+		}).Debug("Signing repository index")
+
+		c := exec.Command("gpg", "--batch", "--yes", "--local-user", key, "--detach-sign", "--output", sig, path)
+		if out, err := c.CombinedOutput(); err != nil {
+			os.Remove(sig)
+			log.WithFields(log.Fields{
+				"file":  name,
+				"key":   key,
+				"error": err,
+			}).Error("Failed to sign repository index")
+			return gpgError(err, out)
+		}
+	}
+	return nil
+}
+
+// VerifyIndex will verify the signature of the compressed index within the
+// directory against the public keys in the keyring.
+func VerifyIndex(dir, keyring string) error {
+	path := filepath.Join(dir, IndexXZFile)
+	sig := path + IndexSignatureSuffix
+	if !PathExists(sig) {
+		return ErrIndexNotSigned
+	}
+	// gpgv treats relative keyrings as relative to its home directory
+	keyring, err := filepath.Abs(keyring)
+	if err != nil {
+		return err
+	}
+	if !PathExists(keyring) {
+		return fmt.Errorf("Keyring does not exist: %s", keyring)
+	}
+
+	log.WithFields(log.Fields{
+		"dir":     dir,
+		"keyring": keyring,
+	}).Debug("Verifying repository index")
+
+	c := exec.Command("gpgv", "--keyring", keyring, sig, path)
+	if out, err := c.CombinedOutput(); err != nil {
+		return gpgError(err, out)
+	}
+	return nil
+}
@@ -19,11 +19,12 @@ package source
 import (
 	"errors"
 	"fmt"
-	"github.com/getsolus/libosdev/commands"
 	git "github.com/libgit2/git2go/v28"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -45,6 +46,9 @@ type GitSource struct {
 	Ref       string
 	BaseName  string
 	ClonePath string // This is where we will have cloned into
+	Commit    string // The commit checked out for the build, once fetched
+
+	out io.Writer // Where git progress is written to
 }
 
 // NewGit will create a new GitSource for the given URI & ref combination.
@@ -68,6 +72,7 @@ func NewGit(uri, ref string) (*GitSource, error) {
 		Ref:       ref,
 		BaseName:  bs,
 		ClonePath: clonePath,
+		out:       os.Stdout,
 	}
 
 	return g, nil
@@ -83,10 +88,15 @@ func (g *GitSource) completed(r git.RemoteCompletion) git.ErrorCode {
 
 // message will be called to emit standard git text to the terminal
 func (g *GitSource) message(str string) git.ErrorCode {
-	os.Stdout.Write([]byte(str))
+	g.out.Write([]byte(str))
 	return 0
 }
 
+// SetOutput will set where git progress is written to
+func (g *GitSource) SetOutput(w io.Writer) {
+	g.out = w
+}
+
 // CreateCallbacks will create the default git callbacks
 func (g *GitSource) CreateCallbacks() git.RemoteCallbacks {
 	return git.RemoteCallbacks{
@@ -247,6 +257,8 @@ func (g *GitSource) resetOnto(repo *git.Repository, ref string) error {
 		return err
 	}
 
+	// Tags may not point at the commit directly
+	g.Commit = commit.Id().String()
 	return nil
 }
 
@@ -254,8 +266,11 @@ func (g *GitSource) resetOnto(repo *git.Repository, ref string) error {
 // reset has taken place.
 func (g *GitSource) submodules() error {
 	// IDK What else to tell ya, git2go submodules is broken
-	cmd := []string{"submodule", "update", "--init", "--recursive"}
-	return commands.ExecStdoutArgsDir(g.ClonePath, "git", cmd)
+	c := exec.Command("git", "submodule", "update", "--init", "--recursive")
+	c.Dir = g.ClonePath
+	c.Stdout = g.out
+	c.Stderr = g.out
+	return c.Run()
 }
 
 // Fetch will attempt to download the git tree locally. If it already exists
@@ -326,6 +341,11 @@ func (g *GitSource) GetBindConfiguration(sourcedir string) BindConfiguration {
 	}
 }
 
+// Resolved will return the commit checked out for the build
+func (g *GitSource) Resolved() string {
+	return g.Commit
+}
+
 // GetIdentifier will return a human readable string to represent this
 // git source in the event of errors.
 func (g *GitSource) GetIdentifier() string {
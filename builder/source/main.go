@@ -17,6 +17,7 @@
 package source
 
 import (
+	"io"
 	"os"
 	"strings"
 )
@@ -64,6 +65,14 @@ type Source interface {
 	// GetIdentifier will return the appropriate representation for a given
 	// source URL.
 	GetIdentifier() string
+
+	// SetOutput will set where any progress of the Fetch is written to.
+	// By default this is the terminal.
+	SetOutput(w io.Writer)
+
+	// Resolved should return exactly what was used for the build once the
+	// source has been fetched, i.e. a checksum or commit.
+	Resolved() string
 }
 
 // New will return a new source for the specified URL.
@@ -24,6 +24,7 @@ import (
 	curl "github.com/andelf/go-curl"
 	"github.com/cheggaaa/pb/v3"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -39,6 +40,7 @@ type SimpleSource struct {
 	validator string // Validation key for this source
 
 	url *url.URL
+	out io.Writer // Where download progress is written to
 }
 
 // NewSimple will create a new source instance
@@ -58,6 +60,16 @@ func NewSimple(uri, validator string, legacy bool) (*SimpleSource, error) {
 	return ret, nil
 }
 
+// SetOutput will set where download progress is written to
+func (s *SimpleSource) SetOutput(w io.Writer) {
+	s.out = w
+}
+
+// Resolved will return the checksum the source was validated against
+func (s *SimpleSource) Resolved() string {
+	return s.validator
+}
+
 // GetIdentifier will return the URI associated with this source.
 func (s *SimpleSource) GetIdentifier() string {
 	return s.URI
@@ -122,6 +134,9 @@ func (s *SimpleSource) download(destination string) error {
 	pbar.Set(pb.Bytes, true)
 	pbar.Set("prefix", filepath.Base(destination))
 	pbar.SetMaxWidth(80)
+	if s.out != nil {
+		pbar.SetWriter(s.out)
+	}
 
 	writer := func(data []byte, udata interface{}) bool {
 		if _, err := out.Write(data); err != nil {
@@ -0,0 +1,10 @@
+inherit = "unstable"
+
+# Enable every repo, including the inherited ones
+add_repos = ['*']
+
+# Override an inherited repo
+[repo.Local]
+uri = "/var/lib/child"
+local = true
+priority = 10
@@ -0,0 +1 @@
+inherit = "cycle-b"
@@ -0,0 +1,2 @@
+inherit = "cycle-a"
+image = "unstable-x86_64"
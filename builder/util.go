@@ -17,15 +17,16 @@
 package builder
 
 import (
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/getsolus/libosdev/commands"
 	"github.com/getsolus/libosdev/disk"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -47,6 +48,22 @@ type PidNotifier interface {
 	SetActivePID(int)
 }
 
+// An OutputProvider is a PidNotifier that wants the output of commands to be
+// sent somewhere other than the standard output and error streams.
+type OutputProvider interface {
+	Output() (stdout, stderr io.Writer)
+}
+
+// outputFor will return where command output should be written to
+func outputFor(notif PidNotifier) (io.Writer, io.Writer) {
+	if p, ok := notif.(OutputProvider); ok {
+		if stdout, stderr := p.Output(); stdout != nil && stderr != nil {
+			return stdout, stderr
+		}
+	}
+	return os.Stdout, os.Stderr
+}
+
 // ActivateRoot will do the hard work of actually bring up the overlayfs
 // system to allow manipulation of the roots for builds, etc.
 func (p *Package) ActivateRoot(overlay *Overlay) error {
@@ -73,7 +90,11 @@ func (p *Package) DeactivateRoot(overlay *Overlay) {
 	MurderDeathKill(overlay.MountPoint)
 	mountMan := disk.GetMountManager()
 	commands.SetStdin(nil)
-	overlay.Unmount()
+	if err := overlay.Unmount(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to tear down overlay")
+	}
 	log.Debug("Requesting unmount of all remaining mountpoints")
 	mountMan.UnmountAll()
 }
@@ -188,10 +209,8 @@ func SaneEnvironment(username, home string) []string {
 // ChrootExec is a simple wrapper to return a correctly set up chroot command,
 // so that we can store the PID, for long running tasks
 func ChrootExec(notif PidNotifier, dir, command string) error {
-	args := []string{dir, "/bin/sh", "-c", command}
-	c := exec.Command("chroot", args...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	c := chrootCommand(dir, "/bin/sh", "-c", command)
+	c.Stdout, c.Stderr = outputFor(notif)
 	c.Stdin = nil
 	c.Env = ChrootEnvironment
 	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
@@ -206,10 +225,8 @@ func ChrootExec(notif PidNotifier, dir, command string) error {
 // ChrootExecStdin is almost identical to ChrootExec, except it permits a stdin
 // to be associated with the command
 func ChrootExecStdin(notif PidNotifier, dir, command string) error {
-	args := []string{dir, "/bin/sh", "-c", command}
-	c := exec.Command("chroot", args...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	c := chrootCommand(dir, "/bin/sh", "-c", command)
+	c.Stdout, c.Stderr = outputFor(notif)
 	c.Stdin = os.Stdin
 	c.Env = ChrootEnvironment
 
@@ -273,3 +290,15 @@ func FileSha256sum(path string) (string, error) {
 	h.Write(mfile.Data)
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// FileSha1sum is a quick wrapper to grab the sha1sum for the given file
+func FileSha1sum(path string) (string, error) {
+	mfile, err := MapFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer mfile.Close()
+	h := sha1.New()
+	h.Write(mfile.Data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,341 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// tmpfsSizePattern matches the size option of a tmpfs mount
+	tmpfsSizePattern = regexp.MustCompile(`^([0-9]+[kKmMgGtTpPeE]?|[0-9]+%)$`)
+
+	// remoteRepoSchemes are the URI schemes eopkg can fetch an index from
+	remoteRepoSchemes = []string{"http", "https", "ftp", "file"}
+)
+
+// A ConfigError is a problem with a key in a configuration or profile file
+type ConfigError struct {
+	Path    string // File the problem was found in
+	Line    int    // Line of the key within the file, or 0 if unknown
+	Message string // Description of the problem
+}
+
+// Error will describe the problem along with where it was found
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Message)
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+	return e.Message
+}
+
+// ConfigErrors are all of the problems found while loading files
+type ConfigErrors []*ConfigError
+
+// Error will describe each problem on its own line
+func (e ConfigErrors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// asError will return nil when there are no problems, rather than an empty set
+func (e ConfigErrors) asError() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// IsValidTmpfsSize will determine whether the size may be passed to a tmpfs
+// mount, i.e. "4G" or "50%". An empty size is valid and means the default.
+func IsValidTmpfsSize(size string) bool {
+	size = strings.TrimSpace(size)
+	return size == "" || tmpfsSizePattern.MatchString(size)
+}
+
+// keyLine will find the line that sets the key within the TOML content, or 0
+// if it can't be found. Only the layout used by solbuild files is understood,
+// i.e. [table] headers followed by key = value lines.
+func keyLine(content []byte, key toml.Key) int {
+	want := key.String()
+	table := ""
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			if idx := strings.Index(line, "#"); idx > 0 {
+				line = line[:idx]
+			}
+			table = strings.NewReplacer("[", "", "]", "", `"`, "", " ", "").Replace(line)
+			if table == want {
+				return i + 1
+			}
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := strings.Trim(strings.TrimSpace(line[:idx]), `"'`)
+		if table != "" {
+			name = table + "." + name
+		}
+		if name == want {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// newConfigError will create an error for the key within the file. If the
+// content isn't given it is read from the file to find the line.
+func newConfigError(path string, content []byte, key toml.Key, format string, a ...interface{}) *ConfigError {
+	if content == nil && path != "" {
+		content, _ = ioutil.ReadFile(path)
+	}
+	return &ConfigError{
+		Path:    path,
+		Line:    keyLine(content, key),
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// tomlTypeName will return the TOML name for values of the Go type
+func tomlTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "table"
+	}
+}
+
+// typeErrors will compare the decoded TOML value against the Go type it is
+// meant to be decoded into, reporting each key with the wrong type.
+func typeErrors(path string, content []byte, key toml.Key, value interface{}, t reflect.Type) ConfigErrors {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var errs ConfigErrors
+	ok := false
+	switch t.Kind() {
+	case reflect.Struct:
+		var table map[string]interface{}
+		if table, ok = value.(map[string]interface{}); !ok {
+			break
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("toml"), ",")[0]
+			if v, found := table[name]; found && name != "" && name != "-" {
+				errs = append(errs, typeErrors(path, content, append(key[:len(key):len(key)], name), v, f.Type)...)
+			}
+		}
+	case reflect.Map:
+		var table map[string]interface{}
+		if table, ok = value.(map[string]interface{}); !ok {
+			break
+		}
+		for name, v := range table {
+			errs = append(errs, typeErrors(path, content, append(key[:len(key):len(key)], name), v, t.Elem())...)
+		}
+	case reflect.Slice, reflect.Array:
+		var array []interface{}
+		if array, ok = value.([]interface{}); !ok {
+			break
+		}
+		for _, v := range array {
+			if errs = typeErrors(path, content, key, v, t.Elem()); len(errs) > 0 {
+				break
+			}
+		}
+	case reflect.String:
+		_, ok = value.(string)
+	case reflect.Bool:
+		_, ok = value.(bool)
+	case reflect.Float32, reflect.Float64:
+		_, ok = value.(float64)
+	default:
+		_, ok = value.(int64)
+	}
+	if !ok {
+		errs = append(errs, newConfigError(path, content, key, "Invalid value for %v, expected %s", key, tomlTypeName(t)))
+	}
+	return errs
+}
+
+// decodeConfigFile will strictly decode the TOML content of the file into v,
+// reporting any keys that are unknown or have the wrong type.
+func decodeConfigFile(path string, content []byte, v interface{}) (toml.MetaData, error) {
+	md, err := toml.Decode(string(content), v)
+	if err != nil {
+		// Syntax errors already include the line, but type errors don't say
+		// which key is at fault.
+		var table map[string]interface{}
+		if _, perr := toml.Decode(string(content), &table); perr == nil {
+			if errs := typeErrors(path, content, nil, table, reflect.TypeOf(v)); len(errs) > 0 {
+				sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+				return md, errs
+			}
+		}
+		return md, &ConfigError{Path: path, Message: err.Error()}
+	}
+
+	// Only report the outermost unknown key, not everything within it
+	var errs ConfigErrors
+	var unknown []string
+	for _, key := range md.Undecoded() {
+		name := key.String()
+		reported := false
+		for _, u := range unknown {
+			if strings.HasPrefix(name, u+".") {
+				reported = true
+			}
+		}
+		if reported {
+			continue
+		}
+		unknown = append(unknown, name)
+		errs = append(errs, newConfigError(path, content, key, "Unknown key %v", name))
+	}
+	return md, errs.asError()
+}
+
+// Validate will ensure the merged configuration values are usable, reporting
+// problems against the file that set them.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	keyError := func(key, format string, a ...interface{}) {
+		errs = append(errs, newConfigError(c.Sources[key], nil, strings.Split(key, "."), format, a...))
+	}
+	if !IsValidTmpfsSize(c.TmpfsSize) {
+		keyError("tmpfs_size", "Invalid tmpfs_size %q, expected a size such as 4G or 50%%", c.TmpfsSize)
+	}
+	if timeout := strings.TrimSpace(c.BuildTimeout); timeout != "" {
+		if _, err := time.ParseDuration(timeout); err != nil {
+			keyError("build_timeout", "Invalid build_timeout %q, expected a duration such as 4h", c.BuildTimeout)
+		}
+	}
+	if err := c.Limits.Validate(); err != nil {
+		keyError("limits", "%v", err)
+	}
+	return errs.asError()
+}
+
+// validateRemoteURI will ensure eopkg could fetch the index of a remote repo
+func validateRemoteURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range remoteRepoSchemes {
+		if u.Scheme == scheme && (u.Host != "" || u.Path != "") {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected a URL such as https://host/eopkg-index.xml.xz")
+}
+
+// CheckRepos will ensure the directory of each local repo exists on the host
+func (p *Profile) CheckRepos() error {
+	var names []string
+	for name := range p.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ConfigErrors
+	for _, name := range names {
+		repo := p.Repos[name]
+		if !repo.Local {
+			continue
+		}
+		if st, err := os.Stat(repo.URI); err != nil || !st.IsDir() {
+			errs = append(errs, newConfigError(repo.path, nil, toml.Key{"repo", name, "uri"}, "Local repo %v does not exist: %v", name, repo.URI))
+		}
+	}
+	return errs.asError()
+}
+
+// CheckConfig will validate the configuration and every profile within the
+// system paths, returning each problem found.
+func CheckConfig() []error {
+	var errs []error
+	seen := make(map[string]bool)
+	add := func(path string, err error) {
+		var found ConfigErrors
+		switch e := err.(type) {
+		case nil:
+			return
+		case ConfigErrors:
+			found = e
+		case *ConfigError:
+			found = ConfigErrors{e}
+		default:
+			found = ConfigErrors{&ConfigError{Path: path, Message: err.Error()}}
+		}
+		// Inherited profiles are checked more than once
+		for _, e := range found {
+			if !seen[e.Error()] {
+				seen[e.Error()] = true
+				errs = append(errs, e)
+			}
+		}
+	}
+
+	_, err := NewConfig()
+	add("", err)
+	for _, dir := range ConfigPaths {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*"+ProfileSuffix))
+		for _, path := range paths {
+			profile, err := NewProfileFromPath(path)
+			if err != nil {
+				add(path, err)
+				continue
+			}
+			if !IsValidImage(profile.Image) {
+				add(path, newConfigError(path, nil, toml.Key{"image"}, "Unknown image %v", profile.Image))
+			}
+			add(path, profile.CheckRepos())
+		}
+	}
+	return errs
+}
@@ -0,0 +1,93 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigUnknownKeys(t *testing.T) {
+	defer withConfigPaths(t, map[string]string{
+		"solbuild.conf": "# Typos\nenable_tmpf = true\n\n[limits]\nmemory = \"4G\"\npid = 10\n\n[bogus]\nkey = 1\n",
+	})()
+	_, err := NewConfig()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+	path := filepath.Join(ConfigPaths[0], "solbuild.conf")
+	want := []string{
+		path + ":2: Unknown key enable_tmpf",
+		path + ":6: Unknown key limits.pid",
+		path + ":8: Unknown key bogus",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got:\n%v", len(want), errs)
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Fatalf("Expected %q, got %q", want[i], e.Error())
+		}
+	}
+}
+
+func TestConfigInvalidValues(t *testing.T) {
+	defer withConfigPaths(t, map[string]string{
+		"solbuild.conf": "log_retention = \"5\"\n",
+	})()
+	_, err := NewConfig()
+	if err == nil || !strings.HasSuffix(err.Error(), "solbuild.conf:1: Invalid value for log_retention, expected integer") {
+		t.Fatalf("Expected a type error, got %v", err)
+	}
+
+	defer withConfigPaths(t, map[string]string{
+		"solbuild.conf": "enable_tmpfs = true\ntmpfs_size = \"4 gigs\"\n",
+	})()
+	_, err = NewConfig()
+	if err == nil || !strings.HasSuffix(err.Error(), "solbuild.conf:2: Invalid tmpfs_size \"4 gigs\", expected a size such as 4G or 50%") {
+		t.Fatalf("Expected an invalid tmpfs_size, got %v", err)
+	}
+	for _, size := range []string{"", "4G", "512m", "50%"} {
+		if !IsValidTmpfsSize(size) {
+			t.Fatalf("Tmpfs size should be valid: %v", size)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer withConfigPaths(t, map[string]string{
+		"typo.profile":   "image = \"main-x86_64\"\n[repo.Local]\nuri = \"/nonexistent/repo\"\nlocal = true\nautoindx = true\n",
+		"remote.profile": "image = \"main-x86_64\"\n[repo.Solus]\nuri = \"mirrors.rit.edu/eopkg-index.xml.xz\"\n",
+		"local.profile":  "image = \"main-x86_64\"\n[repo.Local]\nuri = \"/nonexistent/repo\"\nlocal = true\n",
+	})()
+	errs := CheckConfig()
+	want := []string{
+		"local.profile:3: Local repo Local does not exist: /nonexistent/repo",
+		"remote.profile:3: Invalid uri for remote repo Solus",
+		"typo.profile:5: Unknown key repo.Local.autoindx",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got:\n%v", len(want), errs)
+	}
+	for i, e := range errs {
+		if !strings.Contains(e.Error(), want[i]) {
+			t.Fatalf("Expected %q, got %q", want[i], e.Error())
+		}
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"github.com/DataDrake/waterlog/level"
 	"github.com/getsolus/solbuild/builder"
 	"os"
+	"strings"
+	"time"
 )
 
 func init() {
@@ -43,6 +45,13 @@ type BuildFlags struct {
 	Tmpfs           bool   `short:"t" long:"tmpfs"  desc:"Enable building in a tmpfs"`
 	Memory          string `short:"m" long:"memory" desc:"Set the tmpfs size to use"`
 	TransitManifest string `long:"transit-manifest" desc:"Create transit manifest for the given target"`
+	OutputDir       string `short:"o" long:"output-dir" desc:"Store the built packages in this directory"`
+	Publish         bool   `long:"publish"          desc:"Publish the built packages into the profile's local repo"`
+	PublishRepo     string `long:"publish-repo"     desc:"Name of the local repo to publish into, implies --publish"`
+	Wait            bool   `short:"w" long:"wait"   desc:"Wait for the build root if another process is using it"`
+	WaitTimeout     string `long:"wait-timeout"     desc:"Give up waiting for the build root after this long, i.e. 30m, implies --wait"`
+	Timeout         string `long:"timeout"          desc:"Abort the build if it takes longer than this, i.e. 4h"`
+	SkipDepsCheck   bool   `long:"skip-deps-check"  desc:"Don't resolve the build dependencies before starting the build"`
 }
 
 // BuildRun carries out the "build" sub-command
@@ -59,6 +68,9 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 	if os.Geteuid() != 0 {
 		log.Fatalln("You must be root to run build packages")
 	}
+	if !builder.IsValidTmpfsSize(sFlags.Memory) {
+		log.Fatalf("Invalid tmpfs size '%s', expected a size such as 4G or 50%%\n", sFlags.Memory)
+	}
 	// Initialise the build manager
 	manager, err := builder.NewManager()
 	if err != nil {
@@ -73,6 +85,9 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 		log.Fatalf("Failed to load package: %s\n", err)
 	}
 	manager.SetManifestTarget(sFlags.TransitManifest)
+	manager.SetOutputDir(sFlags.OutputDir)
+	manager.SetPublish(sFlags.Publish || sFlags.PublishRepo != "", sFlags.PublishRepo)
+	manager.SetSkipDepsCheck(sFlags.SkipDepsCheck)
 	// Set the package
 	if err := manager.SetPackage(pkg); err != nil {
 		if err == builder.ErrProfileNotInstalled {
@@ -81,8 +96,52 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 		os.Exit(1)
 	}
 	manager.SetTmpfs(sFlags.Tmpfs, sFlags.Memory)
-	if err := manager.Build(); err != nil {
+	manager.AddObserver(builder.ObserverFunc(buildProgress))
+	setLockWait(manager, sFlags.Wait, sFlags.WaitTimeout)
+	if timeout := strings.TrimSpace(sFlags.Timeout); timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("Invalid build timeout '%s': %s\n", timeout, err)
+		}
+		manager.SetBuildTimeout(duration)
+	}
+	if err := manager.Build(signalContext()); err != nil {
+		if err == builder.ErrLockTimeout {
+			os.Exit(ExitLockTimeout)
+		}
+		if err == builder.ErrInterrupted {
+			log.Fatalln("Exiting due to interruption")
+		}
+		if err == builder.ErrTimedOut {
+			log.Errorln("Build timed out")
+			os.Exit(ExitTimedOut)
+		}
+		if err == builder.ErrUnresolvedDeps {
+			log.Fatalln("Missing build dependencies, use --skip-deps-check to build anyway")
+		}
 		log.Fatalln("Failed to build packages")
 	}
 	log.Infoln("Building succeeded")
 }
+
+// buildProgress reports the progress of each phase of the build
+func buildProgress(e *builder.Event) {
+	switch e.Kind {
+	case builder.EventPhaseStarted:
+		if e.Phase.Index() == 0 {
+			log.Infof("%s\n", e.Phase.Description())
+			return
+		}
+		log.Infof("[%d/%d] %s\n", e.Phase.Index(), len(builder.BuildPhases), e.Phase.Description())
+	case builder.EventPhaseFinished:
+		if e.Error != nil {
+			log.Errorf("%s failed after %s\n", e.Phase.Description(), e.Duration.Round(time.Millisecond))
+			return
+		}
+		log.Debugf("%s completed in %s\n", e.Phase.Description(), e.Duration.Round(time.Millisecond))
+	case builder.EventBuildFinished:
+		if e.Error == nil {
+			log.Goodf("Build of %s completed in %s\n", e.Package, e.Duration.Round(time.Second))
+		}
+	}
+}
@@ -34,12 +34,20 @@ func init() {
 var Chroot = cmd.Sub{
 	Name:  "chroot",
 	Short: "Interactively chroot into the package's build environment",
+	Flags: &ChrootFlags{},
 	Run:   ChrootRun,
 }
 
+// ChrootFlags are flags for the "chroot" sub-command
+type ChrootFlags struct {
+	Wait        bool   `short:"w" long:"wait" desc:"Wait for the build root if another process is using it"`
+	WaitTimeout string `long:"wait-timeout"   desc:"Give up waiting for the build root after this long, i.e. 30m, implies --wait"`
+}
+
 // ChrootRun carries out the "chroot" sub-command
 func ChrootRun(r *cmd.Root, s *cmd.Sub) {
 	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*ChrootFlags)
 	if rFlags.Debug {
 		log.SetLevel(level.Debug)
 	}
@@ -70,7 +78,14 @@ func ChrootRun(r *cmd.Root, s *cmd.Sub) {
 		}
 		os.Exit(1)
 	}
-	if err := manager.Chroot(); err != nil {
+	setLockWait(manager, sFlags.Wait, sFlags.WaitTimeout)
+	if err := manager.Chroot(signalContext()); err != nil {
+		if err == builder.ErrLockTimeout {
+			os.Exit(ExitLockTimeout)
+		}
+		if err == builder.ErrInterrupted {
+			log.Fatalln("Exiting due to interruption")
+		}
 		log.Fatalln("Chroot failure")
 	}
 	log.Infoln("Chroot complete")
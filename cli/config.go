@@ -0,0 +1,99 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"text/tabwriter"
+)
+
+func init() {
+	cmd.Register(&Config)
+}
+
+// Config inspects the solbuild configuration
+var Config = cmd.Sub{
+	Name:  "config",
+	Short: "Inspect the solbuild configuration",
+	Args:  &ConfigArgs{},
+	Run:   ConfigRun,
+}
+
+// ConfigArgs are arguments for the "config" sub-command
+type ConfigArgs struct {
+	Action string `desc:"One of show or check"`
+}
+
+// ConfigRun carries out the "config" sub-command
+func ConfigRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	args := s.Args.(*ConfigArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	switch args.Action {
+	case "show":
+		configShow()
+	case "check":
+		configCheck()
+	default:
+		log.Fatalf("Unknown config action '%s', must be one of show or check\n", args.Action)
+	}
+}
+
+// configCheck validates the configuration and every profile
+func configCheck() {
+	errs := builder.CheckConfig()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if len(errs) > 0 {
+		log.Fatalf("Found %d problems in the solbuild configuration\n", len(errs))
+	}
+	fmt.Println("No problems found in the solbuild configuration")
+}
+
+// configShow prints each value of the merged configuration and its source
+func configShow() {
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration: %s\n", err)
+	}
+	values, err := config.Values()
+	if err != nil {
+		log.Fatalf("Failed to show solbuild configuration: %s\n", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, v := range values {
+		source := v.Source
+		if source == "" {
+			source = "(default)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", v.Key, v.Value, source)
+	}
+	tw.Flush()
+}
@@ -17,7 +17,6 @@
 package cli
 
 import (
-	"fmt"
 	"github.com/DataDrake/cli-ng/cmd"
 	log "github.com/DataDrake/waterlog"
 	"github.com/DataDrake/waterlog/format"
@@ -41,8 +40,11 @@ var Index = cmd.Sub{
 
 // IndexFlags are flags for the "index" sub-command
 type IndexFlags struct {
-	Tmpfs  bool   `short:"t" long:"tmpfs"  desc:"Enable building in a tmpfs"`
-	Memory string `short:"m" long:"memory" desc:"Set the tmpfs size to use"`
+	Tmpfs       bool   `short:"t" long:"tmpfs"  desc:"Ignored, indexing no longer uses a build root"`
+	Memory      string `short:"m" long:"memory" desc:"Ignored, indexing no longer uses a build root"`
+	Wait        bool   `short:"w" long:"wait"   desc:"Wait if another process is indexing the directory"`
+	WaitTimeout string `long:"wait-timeout"     desc:"Give up waiting for the other process after this long, i.e. 30m, implies --wait"`
+	SigningKey  string `long:"signing-key"      desc:"Sign the index with this gpg key"`
 }
 
 // IndexArgs are args for the "index" sub-command
@@ -68,20 +70,22 @@ func IndexRun(r *cmd.Root, s *cmd.Sub) {
 	if err != nil {
 		os.Exit(1)
 	}
-	// Safety first..
-	if err = manager.SetProfile(rFlags.Profile); err != nil {
-		os.Exit(1)
-	}
-	// Set the package
-	if err := manager.SetPackage(&builder.IndexPackage); err != nil {
-		if err == builder.ErrProfileNotInstalled {
-			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
+	// A profile is only needed to find the signing key of its local repo
+	if rFlags.Profile != "" {
+		if err := manager.SetProfile(rFlags.Profile); err != nil {
+			os.Exit(1)
 		}
-		os.Exit(1)
 	}
-	manager.SetTmpfs(sFlags.Tmpfs, sFlags.Memory)
+	manager.SetSigningKey(sFlags.SigningKey)
+	setLockWait(manager, sFlags.Wait, sFlags.WaitTimeout)
 	args := s.Args.(*IndexArgs)
-	if err := manager.Index(args.Dir); err != nil {
+	if err := manager.Index(signalContext(), args.Dir); err != nil {
+		if err == builder.ErrLockTimeout {
+			os.Exit(ExitLockTimeout)
+		}
+		if err == builder.ErrInterrupted {
+			log.Fatalln("Exiting due to interruption")
+		}
 		log.Fatalln("Index failure")
 	}
 	log.Infoln("Indexing complete")
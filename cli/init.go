@@ -146,7 +146,7 @@ func downloadImage(bk *builder.BackingImage) (err error) {
 
 // doUpdate will perform an update to the image after the initial init stage
 func doUpdate(manager *builder.Manager) {
-	if err := manager.Update(); err != nil {
+	if err := manager.Update(signalContext()); err != nil {
 		log.Fatalf("Update failed, reason: '%s'\n", err)
 	}
 }
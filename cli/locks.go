@@ -0,0 +1,126 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	cmd.Register(&Locks)
+}
+
+// Locks lists the lockfiles currently on disk
+var Locks = cmd.Sub{
+	Name:  "locks",
+	Short: "List active and stale solbuild locks",
+	Flags: &LocksFlags{},
+	Run:   LocksRun,
+}
+
+// LocksFlags are the flags for the "locks" sub-command
+type LocksFlags struct {
+	Clean bool `short:"c" long:"clean" desc:"Remove stale locks left behind by dead processes"`
+}
+
+// LocksRun carries out the "locks" sub-command
+func LocksRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*LocksFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if sFlags.Clean && os.Geteuid() != 0 {
+		log.Fatalln("You must be root to clean locks")
+	}
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration: %s\n", err)
+	}
+	locks, err := builder.GetAllLocks(config)
+	if err != nil {
+		log.Fatalf("Failed to list locks: %s\n", err)
+	}
+	if len(locks) == 0 {
+		log.Infoln("No locks found")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tPID\tOPERATION\tPACKAGE\tPROFILE\tSTARTED\tUSER\tPATH")
+	for _, l := range locks {
+		state := "stale"
+		if l.Active {
+			state = "active"
+		}
+		info := l.Info
+		if info == nil {
+			info = &builder.LockInfo{}
+		}
+		started := "-"
+		if !info.Started.IsZero() {
+			started = info.Started.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", state, orDash(info.PID),
+			orDash(info.Operation), orDash(info.Package), orDash(info.Profile),
+			started, orDash(info.User), l.Path)
+	}
+	tw.Flush()
+	if !sFlags.Clean {
+		return
+	}
+	failed := false
+	for _, l := range locks {
+		if l.Active {
+			continue
+		}
+		if err := l.Clear(); err != nil {
+			log.Errorf("Failed to remove lock '%s', reason: %s\n", l.Path, err)
+			failed = true
+			continue
+		}
+		log.Infof("Removed stale lock '%s'\n", l.Path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// orDash will return a printable value for the locks table
+func orDash(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		if t != "" {
+			return t
+		}
+	case int:
+		if t > 0 {
+			return fmt.Sprintf("%d", t)
+		}
+	}
+	return "-"
+}
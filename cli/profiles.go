@@ -0,0 +1,152 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	cmd.Register(&Profiles)
+}
+
+// Profiles lists the available profiles, or shows one of them
+var Profiles = cmd.Sub{
+	Name:  "profiles",
+	Short: "List the available profiles or show a resolved profile",
+	Args:  &ProfilesArgs{},
+	Run:   ProfilesRun,
+}
+
+// ProfilesArgs are the args for the "profiles" sub-command. Only the last
+// argument may be optional, so the action and profile share it.
+type ProfilesArgs struct {
+	Args []string `zero:"yes" desc:"One of list or show, list by default, then the profile to show instead of the one given with -p or the default"`
+}
+
+// ProfilesRun carries out the "profiles" sub-command
+func ProfilesRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	args := s.Args.(*ProfilesArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	action := "list"
+	if len(args.Args) > 0 {
+		action = args.Args[0]
+	}
+	switch action {
+	case "list":
+		if len(args.Args) > 1 {
+			log.Fatalln("Unexpected arguments to list")
+		}
+		profilesList()
+	case "show":
+		if len(args.Args) > 2 {
+			log.Fatalln("Only one profile may be shown")
+		}
+		name := rFlags.Profile
+		if len(args.Args) == 2 {
+			name = args.Args[1]
+		}
+		profilesShow(name)
+	default:
+		log.Fatalf("Unknown profiles action '%s', must be one of list or show\n", action)
+	}
+}
+
+// profilesList prints every available profile and its status
+func profilesList() {
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration: %s\n", err)
+	}
+	profiles, err := builder.GetAllProfiles()
+	if err != nil {
+		log.Fatalf("Failed to load profiles: %s\n", err)
+	}
+	if len(profiles) == 0 {
+		log.Fatalln("No profiles installed. Reinstall solbuild")
+	}
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROFILE\tIMAGE\tSTATUS\tREPOS\tPATH")
+	for _, name := range names {
+		profile := profiles[name]
+		if name == config.DefaultProfile {
+			name += " (default)"
+		}
+		status := "not fetched"
+		if img := builder.NewBackingImage(profile.Image); img.IsInstalled() {
+			status = "installed"
+		} else if img.IsFetched() {
+			status = "fetched"
+		}
+		var repos []string
+		for _, repo := range profile.ReposToAdd() {
+			repos = append(repos, repo.Name)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, orDash(profile.Image), status,
+			orDash(strings.Join(repos, ", ")), profile.Path)
+	}
+	tw.Flush()
+}
+
+// profilesShow prints the profile after inheritance has been resolved
+func profilesShow(name string) {
+	if name == "" {
+		config, err := builder.NewConfig()
+		if err != nil {
+			log.Fatalf("Failed to load solbuild configuration: %s\n", err)
+		}
+		name = config.DefaultProfile
+	}
+	profile, err := builder.NewProfile(name)
+	if err != nil {
+		log.Fatalf("Failed to load profile '%s': %s\n", name, err)
+	}
+	fmt.Printf("# Profile: %s\n", profile.Name)
+	fmt.Printf("# Loaded from: %s\n", profile.Path)
+	for _, parent := range profile.Parents {
+		fmt.Printf("# Inherits: %s\n", parent)
+	}
+	fmt.Println()
+	// Inheritance is already resolved, so don't suggest otherwise
+	resolved := *profile
+	resolved.Inherit = ""
+	if err = toml.NewEncoder(os.Stdout).Encode(&resolved); err != nil {
+		log.Fatalf("Failed to show profile '%s': %s\n", name, err)
+	}
+}
@@ -0,0 +1,60 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	cmd.Register(&Recover)
+}
+
+// Recover cleans up after solbuild processes that died without cleaning up
+var Recover = cmd.Sub{
+	Name:  "recover",
+	Short: "Clean up mounts and locks left behind by a crashed solbuild",
+	Run:   RecoverRun,
+}
+
+// RecoverRun carries out the "recover" sub-command
+func RecoverRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to recover solbuild roots")
+	}
+	// We don't want a Manager here, it would move us into a new namespace
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration: %s\n", err)
+	}
+	if err := builder.Recover(config); err != nil {
+		log.Fatalf("Recovery incomplete: %s\n", err)
+	}
+	log.Infoln("Recovery complete")
+}
@@ -0,0 +1,234 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+func init() {
+	cmd.Register(&Repo)
+}
+
+// Repo manages the local repositories declared in a profile
+var Repo = cmd.Sub{
+	Name:  "repo",
+	Short: "Manage the local repositories of a profile",
+	Flags: &RepoFlags{},
+	Args:  &RepoArgs{},
+	Run:   RepoRun,
+}
+
+// RepoFlags are the flags for the "repo" sub-command
+type RepoFlags struct {
+	Keep int `short:"k" long:"keep" desc:"Releases of each package to keep when pruning, instead of publish_retain"`
+}
+
+// RepoArgs are the args for the "repo" sub-command
+type RepoArgs struct {
+	Action   string   `desc:"One of list, add, remove, prune or index"`
+	Profile  string   `desc:"Profile declaring the repository"`
+	Repo     string   `desc:"Name of the local repository within the profile"`
+	Packages []string `zero:"yes" desc:"Files to add, or names of packages to list, remove or prune"`
+}
+
+// RepoRun carries out the "repo" sub-command
+func RepoRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*RepoFlags)
+	args := s.Args.(*RepoArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	profile, err := builder.NewProfile(args.Profile)
+	if err != nil {
+		log.Fatalf("Failed to load profile '%s': %s\n", args.Profile, err)
+	}
+	repo, err := profile.LocalRepo(args.Repo)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	if args.Action == "list" {
+		repoList(repo, args.Packages)
+		return
+	}
+	ctx := signalContext()
+	switch args.Action {
+	case "add":
+		repoAdd(ctx, repo, args.Packages)
+	case "remove":
+		repoRemove(ctx, repo, args.Packages)
+	case "prune":
+		repoPrune(ctx, repo, args.Packages, sFlags.Keep)
+	case "index":
+		repoIndex(ctx, repo)
+	default:
+		log.Fatalf("Unknown repo action '%s', must be one of list, add, remove, prune or index\n", args.Action)
+	}
+}
+
+// repoList prints the packages within the index of the repo
+func repoList(repo *builder.Repo, names []string) {
+	pkgs, err := builder.ReadIndex(repo.URI)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Fatalf("Repository '%s' has not been indexed\n", repo.Name)
+		}
+		log.Fatalf("Failed to read index of '%s': %s\n", repo.Name, err)
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tRELEASE\tARCH\tDELTAS\tFILE")
+	for _, p := range pkgs {
+		if len(wanted) > 0 && !wanted[p.Name] {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\n", p.Name, p.Version, p.Release, p.Arch, p.Deltas, p.URI)
+	}
+	tw.Flush()
+}
+
+// repoLock takes the lock on the repo for the operation, so that it can't
+// change under a build publishing to it or another process indexing it. Only
+// adding packages may create the repo.
+func repoLock(ctx context.Context, repo *builder.Repo, operation string, create bool) func() {
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to change repositories")
+	}
+	if !create && !builder.PathExists(repo.URI) {
+		log.Fatalf("Repository '%s' does not exist: %s\n", repo.Name, repo.URI)
+	}
+	unlock, err := builder.LockRepo(ctx, repo.URI, operation)
+	if err != nil {
+		if err == context.Canceled {
+			log.Fatalln("Exiting due to interruption")
+		}
+		log.Fatalf("Failed to lock '%s': %s\n", repo.Name, err)
+	}
+	return unlock
+}
+
+// repoAdd copies the package files into the repo
+func repoAdd(ctx context.Context, repo *builder.Repo, files []string) {
+	if len(files) == 0 {
+		log.Fatalln("No packages given to add")
+	}
+	for _, file := range files {
+		if _, err := builder.ParseEopkgFilename(file); err != nil {
+			log.Fatalf("Cannot add '%s': %s\n", file, err)
+		}
+		if !builder.PathExists(file) {
+			log.Fatalf("Cannot add '%s': file does not exist\n", file)
+		}
+	}
+	defer repoLock(ctx, repo, "adding", true)()
+	added, err := builder.AddToRepo(repo, files)
+	for _, path := range added {
+		log.Goodf("Added %s\n", filepath.Base(path))
+	}
+	if err != nil {
+		log.Fatalf("Failed to add packages to '%s': %s\n", repo.Name, err)
+	}
+	repoReindex(ctx, repo)
+}
+
+// repoRemove removes every release of the named packages from the repo
+func repoRemove(ctx context.Context, repo *builder.Repo, names []string) {
+	if len(names) == 0 {
+		log.Fatalln("No packages given to remove")
+	}
+	defer repoLock(ctx, repo, "removing", false)()
+	removed, err := builder.RemoveFromRepo(repo.URI, names)
+	for _, path := range removed {
+		log.Infof("Removed %s\n", filepath.Base(path))
+	}
+	if err != nil {
+		log.Fatalf("Failed to remove packages from '%s': %s\n", repo.Name, err)
+	}
+	if len(removed) == 0 {
+		log.Warnf("No matching packages found in '%s'\n", repo.Name)
+		return
+	}
+	repoReindex(ctx, repo)
+}
+
+// repoPrune removes old releases of the packages from the repo
+func repoPrune(ctx context.Context, repo *builder.Repo, names []string, keep int) {
+	if keep < 1 {
+		config, err := builder.NewConfig()
+		if err != nil {
+			log.Fatalf("Failed to load solbuild configuration: %s\n", err)
+		}
+		keep = config.PublishRetain
+	}
+	if keep < 1 {
+		log.Fatalln("publish_retain keeps every release, use --keep to prune")
+	}
+	defer repoLock(ctx, repo, "pruning", false)()
+	removed, err := builder.PruneRepo(repo.URI, names, keep)
+	for _, path := range removed {
+		log.Infof("Removed %s\n", filepath.Base(path))
+	}
+	if err != nil {
+		log.Fatalf("Failed to prune '%s': %s\n", repo.Name, err)
+	}
+	if len(removed) == 0 {
+		log.Infoln("Nothing to prune")
+		return
+	}
+	repoReindex(ctx, repo)
+}
+
+// repoIndex always reindexes the repo, regardless of autoindex
+func repoIndex(ctx context.Context, repo *builder.Repo) {
+	defer repoLock(ctx, repo, "indexing", false)()
+	repoWriteIndex(ctx, repo)
+}
+
+// repoReindex updates the index after a change, if the repo is autoindexed.
+// The caller must hold the repo lock.
+func repoReindex(ctx context.Context, repo *builder.Repo) {
+	if !repo.AutoIndex {
+		log.Warnf("Repository '%s' does not have autoindex enabled, run 'solbuild repo index' to update it\n", repo.Name)
+		return
+	}
+	repoWriteIndex(ctx, repo)
+}
+
+// repoWriteIndex writes the index of the repo, with its lock already held
+func repoWriteIndex(ctx context.Context, repo *builder.Repo) {
+	if err := builder.IndexDir(ctx, repo.URI, repo.SigningKey); err != nil {
+		log.Fatalf("Failed to index '%s': %s\n", repo.Name, err)
+	}
+	log.Infoln("Indexing complete")
+}
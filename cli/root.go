@@ -17,8 +17,25 @@
 package cli
 
 import (
+	"context"
 	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// ExitLockTimeout is the exit status used when we gave up waiting for
+	// another process to release a lock, so that callers may retry later.
+	ExitLockTimeout = 75
+
+	// ExitTimedOut is the exit status used when a build exceeded its time
+	// limit, matching that of timeout(1).
+	ExitTimedOut = 124
 )
 
 func init() {
@@ -56,3 +73,34 @@ func FindLikelyArg() string {
 	}
 	return ""
 }
+
+// setLockWait configures the manager to wait for held locks, according to the
+// --wait and --wait-timeout flags. Setting a timeout implies waiting.
+func setLockWait(manager *builder.Manager, wait bool, timeout string) {
+	timeout = strings.TrimSpace(timeout)
+	if !wait && timeout == "" {
+		return
+	}
+	var duration time.Duration
+	if timeout != "" {
+		var err error
+		if duration, err = time.ParseDuration(timeout); err != nil {
+			log.Fatalf("Invalid wait timeout '%s': %s\n", timeout, err)
+		}
+	}
+	manager.SetLockWait(true, duration)
+}
+
+// signalContext returns a context that is cancelled once solbuild is asked to
+// stop by SIGINT, SIGTERM or SIGHUP, allowing the builder to tear down cleanly.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-ch
+		log.Warnf("Received %s, cancelling\n", sig)
+		cancel()
+	}()
+	return ctx
+}
@@ -0,0 +1,97 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"text/tabwriter"
+)
+
+func init() {
+	cmd.Register(&Search)
+}
+
+// Search finds packages by name within the repos of a profile
+var Search = cmd.Sub{
+	Name:  "search",
+	Short: "Search the repositories of a profile for packages",
+	Args:  &SearchArgs{},
+	Run:   SearchRun,
+}
+
+// SearchArgs are the args for the "search" sub-command
+type SearchArgs struct {
+	Term string `desc:"Text to find in the package name or summary"`
+}
+
+// SearchRun carries out the "search" sub-command
+func SearchRun(r *cmd.Root, s *cmd.Sub) {
+	args := s.Args.(*SearchArgs)
+	results := runQuery(r, &builder.Query{Kind: builder.QueryName, Term: args.Term})
+	if len(results) == 0 {
+		log.Fatalf("No packages found matching '%s'\n", args.Term)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tRELEASE\tREPO\tSUMMARY")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", res.Package, res.Version, res.Release, res.Repo, res.Summary)
+	}
+	tw.Flush()
+}
+
+// runQuery answers the query from the repos of the profile, on the host. The
+// repos of the backing image are read from the index cached within it, so a
+// query by file only sees the packages installed in the image. Queries share
+// the image with each other, only waiting for an update to finish.
+func runQuery(r *cmd.Root, q *builder.Query) []*builder.QueryResult {
+	rFlags := r.Flags.(*GlobalFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to read the backing image")
+	}
+	// Initialise the build manager
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+	if err = manager.SetProfile(rFlags.Profile); err != nil {
+		os.Exit(1)
+	}
+	manager.SetLockWait(true, 0)
+	results, err := manager.Query(signalContext(), q)
+	if err != nil {
+		if err == builder.ErrLockTimeout {
+			os.Exit(ExitLockTimeout)
+		}
+		if err == builder.ErrInterrupted {
+			log.Fatalln("Exiting due to interruption")
+		}
+		log.Fatalf("Query failed: %s\n", err)
+	}
+	return results
+}
@@ -35,12 +35,20 @@ var Update = cmd.Sub{
 	Name:  "update",
 	Alias: "up",
 	Short: "Update a solbuild profile",
+	Flags: &UpdateFlags{},
 	Run:   UpdateRun,
 }
 
+// UpdateFlags are flags for the "update" sub-command
+type UpdateFlags struct {
+	Wait        bool   `short:"w" long:"wait" desc:"Wait for the image if another process is using it"`
+	WaitTimeout string `long:"wait-timeout"   desc:"Give up waiting for the image after this long, i.e. 30m, implies --wait"`
+}
+
 // UpdateRun carries out the "update" sub-command
 func UpdateRun(r *cmd.Root, c *cmd.Sub) {
 	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := c.Flags.(*UpdateFlags)
 	if rFlags.Debug {
 		log.SetLevel(level.Debug)
 	}
@@ -62,7 +70,14 @@ func UpdateRun(r *cmd.Root, c *cmd.Sub) {
 		}
 		os.Exit(1)
 	}
-	if err := manager.Update(); err != nil {
+	setLockWait(manager, sFlags.Wait, sFlags.WaitTimeout)
+	if err := manager.Update(signalContext()); err != nil {
+		if err == builder.ErrLockTimeout {
+			os.Exit(ExitLockTimeout)
+		}
+		if err == builder.ErrInterrupted {
+			log.Fatalln("Exiting due to interruption")
+		}
 		if err == builder.ErrProfileNotInstalled {
 			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
 		}
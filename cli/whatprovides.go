@@ -0,0 +1,60 @@
+//
+// Copyright © 2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"text/tabwriter"
+)
+
+func init() {
+	cmd.Register(&WhatProvides)
+}
+
+// WhatProvides finds the packages providing a dependency within the repos of
+// a profile
+var WhatProvides = cmd.Sub{
+	Name:  "whatprovides",
+	Short: "Find the packages providing a pkgconfig, library, binary or file",
+	Args:  &WhatProvidesArgs{},
+	Run:   WhatProvidesRun,
+}
+
+// WhatProvidesArgs are the args for the "whatprovides" sub-command
+type WhatProvidesArgs struct {
+	Query string `desc:"pkgconfig(name), pkgconfig32(name), a library soname, binary name or absolute path"`
+}
+
+// WhatProvidesRun carries out the "whatprovides" sub-command
+func WhatProvidesRun(r *cmd.Root, s *cmd.Sub) {
+	args := s.Args.(*WhatProvidesArgs)
+	q := builder.ParseQuery(args.Query)
+	results := runQuery(r, q)
+	if len(results) == 0 {
+		log.Fatalf("No packages found providing %s '%s'\n", q.Kind, q.Term)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tRELEASE\tREPO\tPROVIDES")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", res.Package, res.Version, res.Release, res.Repo, res.Match)
+	}
+	tw.Flush()
+}
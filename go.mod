@@ -15,6 +15,8 @@ require (
 	github.com/sirupsen/logrus v1.7.0
 	github.com/solus-project/libosdev v0.0.0-20171113084438-39032fc50772 // indirect
 	github.com/spf13/cobra v1.1.1
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/sys v0.0.0-20201204225414-ed752295db88
 	gopkg.in/ini.v1 v1.62.0
 	gopkg.in/yaml.v2 v2.4.0
 )